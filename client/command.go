@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/client/handle"
+	"github.com/wlibo666/filesync/lib/common"
+)
+
+const (
+	COMMAND_USAGE = `usage: client [-conf file] command args...
+commands:
+  versions list <file>               list versions of local file,newest first
+  versions restore <file> <version>  restore local file to version
+  snapshots list <local_dir>         list snapshots of local dir,newest first
+  snapshots take <local_dir>         take snapshot of local dir now
+  snapshots restore <local_dir> <snapshot>
+                                     make local dir the same as snapshot
+  sync [local_dir]                   bring local dir,or all local dirs,up to date with server once
+  sync -src <src_dir> <local_dir>    bring local dir up to date with src dir once
+  verify [-json] [local_dir]         report missing,extra and differing files of local dir,
+                                     or all local dirs,against server
+`
+)
+
+// RunCommand run command instead of daemon and return exit code
+func RunCommand(args []string) int {
+	switch args[0] {
+	case "versions":
+		return runVersions(args[1:])
+	case "snapshots":
+		return runSnapshots(args[1:])
+	case "sync":
+		return runSync(args[1:])
+	case "verify":
+		return runVerify(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command:%s\n%s", args[0], COMMAND_USAGE)
+		return 2
+	}
+}
+
+func runVersions(args []string) int {
+	if len(args) == 2 && args[0] == "list" {
+		versions, err := handle.ListVersions(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list versions of %s failed,err:%s\n", args[1], err.Error())
+			return 1
+		}
+		if len(versions) > 0 {
+			fmt.Fprintf(os.Stdout, "%s\n", strings.Join(versions, "\n"))
+		}
+		return 0
+	}
+	if len(args) == 3 && args[0] == "restore" {
+		err := handle.RestoreVersion(args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restore %s to version %s failed,err:%s\n", args[1], args[2], err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "restore %s to version %s ok\n", args[1], args[2])
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s", COMMAND_USAGE)
+	return 2
+}
+
+func runSnapshots(args []string) int {
+	if len(args) == 2 && args[0] == "list" {
+		snapshots, err := handle.ListSnapshots(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "list snapshots of %s failed,err:%s\n", args[1], err.Error())
+			return 1
+		}
+		if len(snapshots) > 0 {
+			fmt.Fprintf(os.Stdout, "%s\n", strings.Join(snapshots, "\n"))
+		}
+		return 0
+	}
+	if len(args) == 2 && args[0] == "take" {
+		snapshot, err := handle.TakeLocalSnapshot(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "take snapshot of %s failed,err:%s\n", args[1], err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "take snapshot %s of %s ok\n", snapshot, args[1])
+		return 0
+	}
+	if len(args) == 3 && args[0] == "restore" {
+		err := handle.RestoreSnapshot(args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restore %s to snapshot %s failed,err:%s\n", args[1], args[2], err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "restore %s to snapshot %s ok\n", args[1], args[2])
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s", COMMAND_USAGE)
+	return 2
+}
+
+// runSync sync local dirs once,exit code is 1 if any file failed
+func runSync(args []string) int {
+	flagSet := flag.NewFlagSet("sync", flag.ContinueOnError)
+	srcDir := flagSet.String("src", "", "sync from local src dir instead of server,eg: -src /data/src")
+	err := flagSet.Parse(args)
+	if err != nil || flagSet.NArg() > 1 || (*srcDir != "" && flagSet.NArg() != 1) {
+		fmt.Fprintf(os.Stderr, "%s", COMMAND_USAGE)
+		return 2
+	}
+
+	var dirs []*config.FileSyncConf
+	if flagSet.NArg() == 0 {
+		dirs = config.GetClientConf().SyncDirs
+	} else {
+		dir, err := handle.FindLocalSyncDir(flagSet.Arg(0))
+		if err != nil {
+			if *srcDir == "" {
+				fmt.Fprintf(os.Stderr, "sync %s failed,err:%s\n", flagSet.Arg(0), err.Error())
+				return 1
+			}
+			// src dir can be synced to any dir
+			localDir, _ := filepath.Abs(flagSet.Arg(0))
+			dir = &config.FileSyncConf{LocalDirName: localDir}
+		}
+		dirs = []*config.FileSyncConf{dir}
+	}
+
+	code := 0
+	for _, dir := range dirs {
+		var result *handle.SyncResult
+		from := dir.ServerAddr
+		if *srcDir != "" {
+			from = *srcDir
+			result, err = handle.SyncFromDir(*srcDir, dir)
+		} else {
+			result, err = handle.SyncFromServer(dir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sync %s from %s failed,err:%s\n", dir.LocalDirName, from, err.Error())
+			code = 1
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "sync %s from %s,%s\n", dir.LocalDirName, from, result.String())
+		if result.Failed > 0 {
+			code = 1
+		}
+	}
+	if common.DryRun {
+		fmt.Fprintf(os.Stdout, "%s\n", common.DryRunSummary())
+	}
+	return code
+}
+
+// runVerify compare local dirs with server,exit code is 1 if any differs
+func runVerify(args []string) int {
+	flagSet := flag.NewFlagSet("verify", flag.ContinueOnError)
+	jsonOutput := flagSet.Bool("json", false, "output json instead of text,eg: -json")
+	err := flagSet.Parse(args)
+	if err != nil || flagSet.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "%s", COMMAND_USAGE)
+		return 2
+	}
+
+	dirs := config.GetClientConf().SyncDirs
+	if flagSet.NArg() == 1 {
+		dir, err := handle.FindLocalSyncDir(flagSet.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify %s failed,err:%s\n", flagSet.Arg(0), err.Error())
+			return 1
+		}
+		dirs = []*config.FileSyncConf{dir}
+	}
+
+	code := 0
+	results := make([]*handle.VerifyResult, 0, len(dirs))
+	for _, dir := range dirs {
+		result, err := handle.VerifyDir(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify %s against %s failed,err:%s\n", dir.LocalDirName, dir.ServerAddr, err.Error())
+			code = 1
+			continue
+		}
+		if !result.IsSame() {
+			code = 1
+		}
+		results = append(results, result)
+	}
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+		return code
+	}
+	for _, result := range results {
+		fmt.Fprintf(os.Stdout, "local_dir:%s,root:%s,missing:%d,extra:%d,differ:%d\n",
+			result.LocalDir, result.Root, len(result.Missing), len(result.Extra), len(result.Differ))
+		for _, path := range result.Missing {
+			fmt.Fprintf(os.Stdout, "  missing %s\n", path)
+		}
+		for _, path := range result.Extra {
+			fmt.Fprintf(os.Stdout, "  extra   %s\n", path)
+		}
+		for _, path := range result.Differ {
+			fmt.Fprintf(os.Stdout, "  differ  %s\n", path)
+		}
+	}
+	return code
+}
@@ -1,27 +1,285 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/wlibo666/common-lib/log"
 	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
 )
 
 type FileSyncConf struct {
+	Root          string `json:"root"`
 	ServerDirName string `json:"server_dir"`
 	LocalDirName  string `json:"local_dir"`
 	ServerAddr    string `json:"server_addr"`
+	// heartbeat_port of server,port of server_addr is not used for heartbeats
+	ServerHeartBeatPort int    `json:"server_heartbeat_port"`
+	Drift               string `json:"drift"`
+	QuarantineDir       string `json:"quarantine_dir"`
+	// keep previous copies of overwritten and removed files
+	VersionsDir     string `json:"versions_dir"`
+	VersionsKeep    int    `json:"versions_keep"`
+	VersionsMaxDays int    `json:"versions_max_days"`
+	// snapshots of local_dir sharing unchanged files,taken every snapshot_interval seconds or when server ask
+	SnapshotDir      string `json:"snapshot_dir"`
+	SnapshotInterval int    `json:"snapshot_interval"`
+	SnapshotKeep     int    `json:"snapshot_keep"`
+	// ips of server_addr,resolved when config is loaded
+	serverIps []string
+}
+
+const (
+	DRIFT_MODE_REPORT     = "report"
+	DRIFT_MODE_REVERT     = "revert"
+	DRIFT_MODE_QUARANTINE = "quarantine"
+)
+
+// GetRoot return name of root on server,default is the normalized server_dir
+func (dir *FileSyncConf) GetRoot() string {
+	if dir.Root != "" {
+		return dir.Root
+	}
+	return common.NormalizeRootName(dir.ServerDirName)
+}
+
+// GetHeartBeatAddr return heartbeat address of server,it is host of server_addr and
+// server_heartbeat_port,or the default heartbeat port if it is not set
+func (dir *FileSyncConf) GetHeartBeatAddr() string {
+	host := dir.ServerAddr
+	if tmpHost, _, err := net.SplitHostPort(dir.ServerAddr); err == nil {
+		host = tmpHost
+	}
+	port := dir.ServerHeartBeatPort
+	if port == 0 {
+		port = syncproto.HEART_BEAT_LISTENER_PORT
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// IsInternalPath return true if filename is in quarantine_dir,versions_dir or snapshot_dir,
+// they may be inside local_dir but are not part of it
+func (dir *FileSyncConf) IsInternalPath(filename string) bool {
+	absName, err := filepath.Abs(filename)
+	if err != nil {
+		absName = filepath.Clean(filename)
+	}
+	for _, internalDir := range []string{dir.QuarantineDir, dir.VersionsDir, dir.SnapshotDir} {
+		if internalDir == "" {
+			continue
+		}
+		absDir, err := filepath.Abs(internalDir)
+		if err != nil {
+			absDir = filepath.Clean(internalDir)
+		}
+		if common.IsSubDir(absDir, absName) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveServer resolve host of server_addr once,so no dns lookup is done per msg
+func (dir *FileSyncConf) resolveServer() {
+	host := strings.Split(dir.ServerAddr, ":")[0]
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		log.Logger.Warn("resolve server_addr:%s of local_dir:%s failed,err:%s", dir.ServerAddr, dir.LocalDirName, err.Error())
+		return
+	}
+	dir.serverIps = addrs
+}
+
+// IsServer return true if serverIp is the ip of server_addr,
+// host of server_addr is resolved when config is loaded or reloaded
+func (dir *FileSyncConf) IsServer(serverIp string) bool {
+	host := strings.Split(dir.ServerAddr, ":")[0]
+	if host == serverIp {
+		return true
+	}
+	for _, addr := range dir.serverIps {
+		if addr == serverIp {
+			return true
+		}
+	}
+	return false
 }
 
 type FileSyncClientConf struct {
-	ListenAddr string          `json:"listen"`
-	DebugFlag  bool            `json:"debug"`
-	LogFile    string          `json:"log_file"`
-	LogFileNum int             `json:"log_file_num"`
-	SyncDirs   []*FileSyncConf `json:"sync_dir"`
+	ListenAddr        string          `json:"listen"`
+	DebugFlag         bool            `json:"debug"`
+	LogFile           string          `json:"log_file"`
+	LogFileNum        int             `json:"log_file_num"`
+	HashAlgo          string          `json:"hash_algo"`
+	HashCache         string          `json:"hash_cache"`
+	MetricsListen     string          `json:"metrics_listen"`
+	JsonLog           string          `json:"json_log"`
+	ShutdownTimeout   int             `json:"shutdown_timeout"`
+	AuditLog          string          `json:"audit_log"`
+	HeartBeatInterval int             `json:"heartbeat_interval"`
+	SinglePort        bool            `json:"single_port"`
+	ClientId          string          `json:"client_id"`
+	ClientSecret      string          `json:"client_secret"`
+	SyncDirs          []*FileSyncConf `json:"sync_dir"`
 }
 
 var (
-	GClientConf = &FileSyncClientConf{}
+	// running config,replaced when reload
+	clientConf = atomic.Value{}
+	// config file loaded,read again when reload
+	ConfFileName = ""
 )
 
+func init() {
+	clientConf.Store(&FileSyncClientConf{})
+}
+
+// GetClientConf return running config,it is safe to call while config is reloaded
+func GetClientConf() *FileSyncClientConf {
+	return clientConf.Load().(*FileSyncClientConf)
+}
+
+// SetClientConf replace running config
+func SetClientConf(conf *FileSyncClientConf) {
+	clientConf.Store(conf)
+}
+
+// parseConfig read and check config file
+func parseConfig(filename string) (*FileSyncClientConf, error) {
+	conf := &FileSyncClientConf{}
+	err := common.LoadConf(filename, conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = common.DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	if conf.HeartBeatInterval <= 0 {
+		conf.HeartBeatInterval = syncproto.HEART_BEAT_INTERVAL
+	}
+	// identity announced to servers,eg. web-01-9091,clients on one host differ in listen port
+	if conf.ClientId == "" {
+		conf.ClientId, _ = os.Hostname()
+		if _, port, err := net.SplitHostPort(conf.ListenAddr); err == nil && port != "" {
+			conf.ClientId += "-" + port
+		}
+	}
+	if conf.HashAlgo != "" && !common.IsSupportHashAlgo(conf.HashAlgo) {
+		return nil, fmt.Errorf("unsupport hash_algo:%s", conf.HashAlgo)
+	}
+	for _, dir := range conf.SyncDirs {
+		dir.resolveServer()
+		switch dir.Drift {
+		case "", DRIFT_MODE_REPORT, DRIFT_MODE_REVERT:
+		case DRIFT_MODE_QUARANTINE:
+			if dir.QuarantineDir == "" {
+				return nil, fmt.Errorf("quarantine_dir of local_dir:%s is empty", dir.LocalDirName)
+			}
+		default:
+			return nil, fmt.Errorf("unsupport drift:%s of local_dir:%s", dir.Drift, dir.LocalDirName)
+		}
+	}
+	return conf, nil
+}
+
 func LoadConfig(filename string) error {
-	return common.LoadConf(filename, GClientConf)
+	conf, err := parseConfig(filename)
+	if err != nil {
+		return err
+	}
+	SetClientConf(conf)
+	ConfFileName = filename
+	return nil
+}
+
+// ReloadConfig read config file again,options which need restart keep running value
+func ReloadConfig() (*FileSyncClientConf, error) {
+	conf, err := parseConfig(ConfFileName)
+	if err != nil {
+		return nil, err
+	}
+	oldConf := GetClientConf()
+	if conf.ListenAddr != oldConf.ListenAddr || conf.LogFile != oldConf.LogFile ||
+		conf.LogFileNum != oldConf.LogFileNum || conf.HashCache != oldConf.HashCache ||
+		conf.MetricsListen != oldConf.MetricsListen || conf.JsonLog != oldConf.JsonLog ||
+		conf.AuditLog != oldConf.AuditLog || conf.SinglePort != oldConf.SinglePort {
+		log.Logger.Warn("listen,log_file,log_file_num,hash_cache,metrics_listen,json_log,audit_log and single_port need restart to change")
+	}
+	conf.ListenAddr = oldConf.ListenAddr
+	conf.LogFile = oldConf.LogFile
+	conf.LogFileNum = oldConf.LogFileNum
+	conf.HashCache = oldConf.HashCache
+	conf.MetricsListen = oldConf.MetricsListen
+	conf.JsonLog = oldConf.JsonLog
+	conf.AuditLog = oldConf.AuditLog
+	conf.SinglePort = oldConf.SinglePort
+	return conf, nil
+}
+
+// CheckConfig return problems of config file,eg. unknown keys,invalid addresses
+// and overlapping local dirs
+func CheckConfig(filename string) []error {
+	conf, err := parseConfig(filename)
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	keys, err := common.CheckConfKeys(filename, conf)
+	if err != nil {
+		return []error{err}
+	}
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("unknown key:%s", key))
+	}
+	// single port client does not listen
+	if !conf.SinglePort {
+		if err = common.CheckAddr("listen", conf.ListenAddr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.MetricsListen != "" {
+		if err = common.CheckAddr("metrics_listen", conf.MetricsListen); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(conf.SyncDirs) == 0 {
+		errs = append(errs, fmt.Errorf("sync_dir is empty"))
+	}
+	for i, dir := range conf.SyncDirs {
+		if dir.LocalDirName == "" {
+			errs = append(errs, fmt.Errorf("local_dir of sync_dir[%d] is empty", i))
+			continue
+		}
+		if dir.GetRoot() == "" {
+			errs = append(errs, fmt.Errorf("root and server_dir of local_dir:%s are empty", dir.LocalDirName))
+		}
+		if err = common.CheckAddr("server_addr of local_dir:"+dir.LocalDirName, dir.GetHeartBeatAddr()); err != nil {
+			errs = append(errs, err)
+		}
+		// local_dir is created if not exist
+		if fi, err := os.Stat(dir.LocalDirName); err == nil && !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("local_dir:%s is not a dir", dir.LocalDirName))
+		}
+		for _, other := range conf.SyncDirs[:i] {
+			if other.LocalDirName == "" {
+				continue
+			}
+			if common.IsSubDir(other.LocalDirName, dir.LocalDirName) || common.IsSubDir(dir.LocalDirName, other.LocalDirName) {
+				errs = append(errs, fmt.Errorf("local_dir:%s overlaps local_dir:%s", dir.LocalDirName, other.LocalDirName))
+			}
+		}
+		if dir.SnapshotInterval < 0 || dir.SnapshotKeep < 0 || dir.VersionsKeep < 0 || dir.VersionsMaxDays < 0 {
+			errs = append(errs, fmt.Errorf("snapshot_interval,snapshot_keep,versions_keep and versions_max_days of local_dir:%s must not be negative", dir.LocalDirName))
+		}
+	}
+	return errs
 }
@@ -0,0 +1,71 @@
+package handle
+
+import (
+	"os"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+var (
+	// append only log of applied operations,disabled if nil
+	auditLog *common.JsonLogger
+	hostName string
+)
+
+// OpenAuditLog record every applied create/write/remove/rename into filename
+func OpenAuditLog(filename string) error {
+	logger, err := common.NewJsonLogger(filename)
+	if err != nil {
+		return err
+	}
+	hostName, _ = os.Hostname()
+	auditLog = logger
+	return nil
+}
+
+func isAuditMsg(msgType uint32) bool {
+	switch msgType {
+	case syncproto.PROTO_MSG_FILE_CREATE_REQ, syncproto.PROTO_MSG_FILE_WRITE_REQ,
+		syncproto.PROTO_MSG_FILE_REMOVE_REQ, syncproto.PROTO_MSG_FILE_RENAME_REQ:
+		return auditLog != nil
+	}
+	return false
+}
+
+// getAuditHash return hash of regular file before it is changed,empty if none
+func getAuditHash(filename, hashAlgo string) string {
+	fi, err := os.Lstat(filename)
+	if err != nil || !fi.Mode().IsRegular() {
+		return ""
+	}
+	_, fileHash, err := common.GHashCache.GetFileHash(hashAlgo, filename)
+	if err != nil {
+		return ""
+	}
+	return fileHash
+}
+
+func auditFileMsg(destFile string, msg *syncproto.FileSyncProto, hashAlgo, oldHash string, err error) {
+	fields := map[string]interface{}{
+		"host":      hostName,
+		"root":      msg.GetRootName(),
+		"path":      msg.GetRelPath(),
+		"file":      destFile,
+		"op":        syncproto.GetMsgName(msg.GetMsgType()),
+		"hash_algo": hashAlgo,
+		"old_hash":  oldHash,
+	}
+	if msg.GetMsgType() == syncproto.PROTO_MSG_FILE_WRITE_REQ {
+		fields["bytes"] = len(msg.GetContent())
+		fields["hash"], _ = common.GetDataHash(hashAlgo, msg.GetContent())
+	}
+	if err != nil {
+		fields["err"] = err.Error()
+	}
+	logErr := auditLog.Log(fields)
+	if logErr != nil {
+		log.Logger.Error("write audit log of file:%s failed,err:%s", destFile, logErr.Error())
+	}
+}
@@ -0,0 +1,134 @@
+package handle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+// server may be windows or linux,compare paths with slash only
+func toSlash(path string) string {
+	return strings.Replace(path, "\\", "/", -1)
+}
+
+// isWinPath return true if path is windows path,eg. E:\MyCodeBak
+func isWinPath(path string) bool {
+	return strings.Contains(path, "\\")
+}
+
+// checkSymlink reject dest file if it or one of its parents is a symlink out of localDir
+func checkSymlink(localDir, destFile string) error {
+	realDir, err := filepath.EvalSymlinks(localDir)
+	if err != nil {
+		// local dir is not created yet,nothing to escape by
+		return nil
+	}
+	path := destFile
+	for {
+		_, err := os.Lstat(path)
+		if err == nil {
+			break
+		}
+		if path == localDir || filepath.Dir(path) == path {
+			return nil
+		}
+		path = filepath.Dir(path)
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	relPath, err := filepath.Rel(realDir, realPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("dest file:%s escapes from local dir:%s by symlink", destFile, localDir)
+	}
+	return nil
+}
+
+// joinLocalDir return dest file of slash separated relPath under localDir
+func joinLocalDir(localDir, relPath string) (string, error) {
+	// client is windows but we are not,eg. in test
+	if isWinPath(localDir) && filepath.Separator != '\\' {
+		err := common.CheckRelPath(relPath)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(localDir, "\\") + "\\" + strings.Replace(relPath, "/", "\\", -1), nil
+	}
+	cleanDir := filepath.Clean(localDir)
+	destFile, err := common.JoinRelPath(cleanDir, relPath)
+	if err != nil {
+		return "", err
+	}
+	// symlinks are checked on every os
+	err = checkSymlink(cleanDir, destFile)
+	if err != nil {
+		return "", err
+	}
+	return destFile, nil
+}
+
+// resolveRelPath return dest file of slash separated relPath under local_dir of sync dir,
+// internal dirs inside local_dir are not written by server
+func resolveRelPath(dir *config.FileSyncConf, relPath string) (string, error) {
+	destFile, err := joinLocalDir(dir.LocalDirName, relPath)
+	if err != nil {
+		return "", err
+	}
+	if dir.IsInternalPath(destFile) {
+		return "", fmt.Errorf("dest file:%s is in internal dir of local dir:%s", destFile, dir.LocalDirName)
+	}
+	return destFile, nil
+}
+
+// getDestFile return local file of server file,the server file must be under
+// server_dir of one sync dir of the server,the longest server_dir wins
+func getDestFile(serverIp, filename string) (string, error) {
+	var syncDir *config.FileSyncConf
+	relPath := ""
+	name := toSlash(filename)
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if !dir.IsServer(serverIp) {
+			continue
+		}
+		serverDir := strings.TrimRight(toSlash(dir.ServerDirName), "/")
+		if !strings.HasPrefix(name, serverDir+"/") {
+			continue
+		}
+		if syncDir == nil || len(serverDir) > len(strings.TrimRight(toSlash(syncDir.ServerDirName), "/")) {
+			syncDir = dir
+			relPath = strings.TrimLeft(strings.TrimPrefix(name, serverDir+"/"), "/")
+		}
+	}
+	if syncDir == nil {
+		return "", fmt.Errorf("not found dest file by req file:%s", filename)
+	}
+	return resolveRelPath(syncDir, relPath)
+}
+
+// getSyncDir return sync dir of root on server
+func getSyncDir(serverIp, rootName string) (*config.FileSyncConf, error) {
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if dir.GetRoot() == rootName && dir.IsServer(serverIp) {
+			return dir, nil
+		}
+	}
+	return nil, fmt.Errorf("not found sync dir by server:%s,root:%s", serverIp, rootName)
+}
+
+// getMsgDestFile return local file of msg from server,old server only send absolute FileName
+func getMsgDestFile(serverIp string, msg *syncproto.FileSyncProto) (string, error) {
+	if msg.GetRootName() == "" {
+		return getDestFile(serverIp, msg.GetFileName())
+	}
+	dir, err := getSyncDir(serverIp, msg.GetRootName())
+	if err != nil {
+		return "", err
+	}
+	return resolveRelPath(dir, msg.GetRelPath())
+}
@@ -0,0 +1,211 @@
+package handle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+const (
+	// events of file changed by us in this seconds are not drift
+	DRIFT_IGNORE_SECONDS = 5
+	// process drift after file is not changed in this seconds
+	DRIFT_DELAY_SECONDS = 2
+)
+
+var (
+	appliedFiles  = make(map[string]int64)
+	appliedRwLock = sync.RWMutex{}
+)
+
+// markApplied record file changed by us
+func markApplied(filename string) {
+	appliedRwLock.Lock()
+	appliedFiles[filename] = time.Now().Unix()
+	appliedRwLock.Unlock()
+}
+
+// isApplied return true if file or one of its parents is changed by us recently
+func isApplied(filename string) bool {
+	now := time.Now().Unix()
+	appliedRwLock.Lock()
+	defer appliedRwLock.Unlock()
+	for name, t := range appliedFiles {
+		if now-t > DRIFT_IGNORE_SECONDS {
+			delete(appliedFiles, name)
+		}
+	}
+	for path := filename; ; path = filepath.Dir(path) {
+		if _, ok := appliedFiles[path]; ok {
+			return true
+		}
+		if filepath.Dir(path) == path {
+			return false
+		}
+	}
+}
+
+// StartDriftWatch watch local dirs which drift is set,and process changes not made by us.
+// it is called again when reload
+func StartDriftWatch() {
+	runs := make(map[string]func(stop chan bool))
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if dir.Drift == "" {
+			continue
+		}
+		dir := dir
+		runs[getDirKey(dir)] = func(stop chan bool) {
+			err := watchLocalDir(dir, stop)
+			if err != nil {
+				log.Logger.Error("watch local dir:%s failed,err:%s", dir.LocalDirName, err.Error())
+			}
+		}
+	}
+	driftRunners.update(runs)
+}
+
+func addLocalWatch(watcher *fsnotify.Watcher, dir *config.FileSyncConf, baseDir string) {
+	filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if dir.IsInternalPath(path) {
+				return filepath.SkipDir
+			}
+			err = watcher.Add(path)
+			if err != nil {
+				log.Logger.Warn("watch local dir:%s failed,err:%s", path, err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+func watchLocalDir(dir *config.FileSyncConf, stop chan bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if !common.DryRun {
+		os.MkdirAll(dir.LocalDirName, os.ModePerm)
+	}
+	addLocalWatch(watcher, dir, dir.LocalDirName)
+	log.Logger.Info("watch local dir:%s for drift,mode:%s", dir.LocalDirName, dir.Drift)
+
+	pending := make(map[string]int64)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Logger.Info("stop watching local dir:%s for drift", dir.LocalDirName)
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// quarantined files,versions and snapshots are not drift
+			if event.Op&fsnotify.Chmod == fsnotify.Chmod || strings.HasPrefix(filepath.Base(event.Name), TMP_FILE_PREFIX) ||
+				dir.IsInternalPath(event.Name) {
+				continue
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				fi, err := os.Stat(event.Name)
+				if err == nil && fi.IsDir() {
+					addLocalWatch(watcher, dir, event.Name)
+				}
+			}
+			if isApplied(event.Name) {
+				continue
+			}
+			pending[event.Name] = time.Now().Unix()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Logger.Error("watch local dir:%s error:%s", dir.LocalDirName, err.Error())
+		case <-ticker.C:
+			now := time.Now().Unix()
+			for name, t := range pending {
+				if now-t < DRIFT_DELAY_SECONDS {
+					continue
+				}
+				delete(pending, name)
+				err := processDrift(dir, name)
+				if err != nil {
+					log.Logger.Warn("process drift of file:%s failed,err:%s", name, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// processDrift report, revert or quarantine local file changed not by us
+func processDrift(dir *config.FileSyncConf, filename string) error {
+	relPath, err := filepath.Rel(dir.LocalDirName, filename)
+	if err != nil {
+		return err
+	}
+	relPath = filepath.ToSlash(relPath)
+	log.Logger.Warn("drift found,local_dir:%s,file:%s,mode:%s", dir.LocalDirName, relPath, dir.Drift)
+	switch dir.Drift {
+	case config.DRIFT_MODE_REPORT:
+		return nil
+	case config.DRIFT_MODE_QUARANTINE:
+		err = quarantineFile(dir, filename, relPath)
+		if err != nil {
+			return err
+		}
+	}
+	return revertFile(dir, relPath)
+}
+
+// quarantineFile move drifted file to quarantine dir,with time suffix
+func quarantineFile(dir *config.FileSyncConf, filename, relPath string) error {
+	_, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	destFile := filepath.Join(dir.QuarantineDir, filepath.FromSlash(relPath)) + "." + time.Now().Format("20060102150405")
+	if common.DryRun {
+		log.Logger.Info("dry-run: would quarantine file:%s to %s", filename, destFile)
+		common.DryRunRecord("quarantine", 0)
+		return nil
+	}
+	os.MkdirAll(filepath.Dir(destFile), os.ModePerm)
+	log.Logger.Info("quarantine file:%s to %s", filename, destFile)
+	markApplied(filename)
+	return os.Rename(filename, destFile)
+}
+
+// revertFile fetch file from server and apply it
+func revertFile(dir *config.FileSyncConf, relPath string) error {
+	msg := &syncproto.FileSyncProto{
+		MsgType: proto.Uint32(syncproto.PROTO_MSG_FILE_FETCH_REQ),
+		RelPath: proto.String(relPath),
+	}
+	respMsg, err := requestServer(dir, msg)
+	if err != nil {
+		return err
+	}
+	if respMsg.GetRootName() != dir.GetRoot() || respMsg.GetRelPath() != relPath {
+		return fmt.Errorf("server response root:%s,path:%s,not equal request", respMsg.GetRootName(), respMsg.GetRelPath())
+	}
+	log.Logger.Info("revert file:%s of local_dir:%s by %s", relPath, dir.LocalDirName, syncproto.GetMsgName(respMsg.GetMsgType()))
+	return processFileMsg(strings.Split(dir.ServerAddr, ":")[0], respMsg)
+}
@@ -3,6 +3,7 @@ package handle
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -20,95 +21,127 @@ var (
 	ERR_ONLY_SUPPORT_HEARTBEAT_MSG = errors.New("Only support heartbeat msg in this port")
 )
 
+const (
+	TMP_FILE_PREFIX = ".filesync_tmp_"
+)
+
+// StartHeartBeat keep one heartbeat for every server even if it has several roots,
+// it is called again when reload
 func StartHeartBeat() {
-	for _, syncConf := range config.GClientConf.SyncDirs {
-		serverAddr := strings.Split(syncConf.ServerAddr, ":")
-		go func(addr string) {
-			for {
-				serverHeartAddr := fmt.Sprintf("%s:%d", addr, syncproto.HEART_BEAT_LISTENER_PORT)
-				conn, err := net.DialTimeout("tcp", serverHeartAddr, common.DIAL_TIMEOUT*time.Second)
-				if err != nil {
-					log.Logger.Error("Dial for heartbeat to server:%s failed,err:%s", serverHeartAddr, err.Error())
-					time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
-					continue
-				}
-				for {
-					err := HeartBeat(conn)
-					if err != nil {
-						log.Logger.Warn("HeartBeat with server:%s failed,err:%s", conn.RemoteAddr().String(), err.Error())
-						break
-					}
-					time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
-				}
+	runs := make(map[string]func(stop chan bool))
+	for _, syncConf := range config.GetClientConf().SyncDirs {
+		serverHeartAddr := syncConf.GetHeartBeatAddr()
+		runs[serverHeartAddr] = func(stop chan bool) {
+			if config.GetClientConf().SinglePort {
+				singlePortLoop(serverHeartAddr, stop)
+				return
+			}
+			heartBeatLoop(serverHeartAddr, stop)
+		}
+	}
+	heartBeatRunners.update(runs)
+}
+
+func heartBeatLoop(serverHeartAddr string, stop chan bool) {
+	for {
+		conn, err := net.DialTimeout("tcp", serverHeartAddr, common.DIAL_TIMEOUT*time.Second)
+		if err != nil {
+			log.Logger.Error("Dial for heartbeat to server:%s failed,err:%s", serverHeartAddr, err.Error())
+			if waitStop(stop, time.Duration(config.GetClientConf().HeartBeatInterval)*time.Second) {
+				return
+			}
+			continue
+		}
+		// nonce of conn from last heartbeat response,first heartbeat has none
+		nonce := ""
+		for {
+			nonce, err = HeartBeat(conn, serverHeartAddr, nonce)
+			if err != nil {
+				log.Logger.Warn("HeartBeat with server:%s failed,err:%s", conn.RemoteAddr().String(), err.Error())
+				break
+			}
+			if waitStop(stop, time.Duration(config.GetClientConf().HeartBeatInterval)*time.Second) {
+				log.Logger.Info("stop heartbeat with server:%s", serverHeartAddr)
+				conn.Close()
+				return
 			}
-		}(serverAddr[0])
+		}
+		conn.Close()
 	}
 }
 
-func HeartBeat(conn net.Conn) error {
-	msgReq := &syncproto.FileSyncProto{
+// newHeartBeatMsg return heartbeat msg to server,it registers client with its identity,
+// listen address,roots it wants from server and capabilities.
+// nonce is from last heartbeat response of conn
+func newHeartBeatMsg(msgType uint32, serverHeartAddr, nonce string) *syncproto.FileSyncProto {
+	msg := &syncproto.FileSyncProto{
 		Version:    proto.Uint32(syncproto.PROTO_VERSION),
-		MsgType:    proto.Uint32(syncproto.PROTO_MSG_HEART_BETA_REQ),
+		MsgType:    proto.Uint32(msgType),
 		ContentLen: proto.Uint32(0),
+		HashAlgo:   proto.String(getHashAlgos()),
+		ClientId:   proto.String(config.GetClientConf().ClientId),
+	}
+	// server matches client_id in white list only if client proves its secret
+	if config.GetClientConf().ClientSecret != "" && nonce != "" {
+		msg.Token = proto.String(common.NewClientToken(config.GetClientConf().ClientSecret, config.GetClientConf().ClientId, nonce))
+	}
+	if config.GetClientConf().SinglePort {
+		msg.Caps = append(msg.Caps, syncproto.CAP_SINGLE_PORT)
+	} else {
+		msg.ListenAddr = proto.String(config.GetClientConf().ListenAddr)
+	}
+	snapshot := false
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if dir.GetHeartBeatAddr() != serverHeartAddr {
+			continue
+		}
+		msg.Roots = append(msg.Roots, dir.GetRoot())
+		if dir.SnapshotDir != "" {
+			snapshot = true
+		}
 	}
+	if snapshot {
+		msg.Caps = append(msg.Caps, syncproto.CAP_SNAPSHOT)
+	}
+	return msg
+}
+
+// HeartBeat send heartbeat signed with nonce and return nonce of server response
+func HeartBeat(conn net.Conn, serverHeartAddr, nonce string) (string, error) {
+	msgReq := newHeartBeatMsg(syncproto.PROTO_MSG_HEART_BETA_REQ, serverHeartAddr, nonce)
 	msgData, err := proto.Marshal(msgReq)
 	if err != nil {
-		return err
+		return "", err
 	}
+	start := time.Now()
 	err = common.WriteMsg(msgData, conn)
 	if err != nil {
-		return err
+		return "", err
 	}
 	// read heartbeat request msg
 	msgData, err = common.ReadMsg(conn)
 	if err != nil {
 		log.Logger.Warn("ReadMsg from conn:%s failed,err:%s", conn.RemoteAddr().String(), err.Error())
-		return err
+		return "", err
 	}
 	msg := &syncproto.FileSyncProto{}
 	err = proto.Unmarshal(msgData, msg)
 	if err != nil {
 		log.Logger.Warn("proto.Unmarshal failed,err:%s", err.Error())
-		return err
+		return "", err
 	}
 	syncproto.LogMsg(conn, msg)
 	if msg.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_RES {
 		common.WriteMsg([]byte(ERR_ONLY_SUPPORT_HEARTBEAT_MSG.Error()), conn)
-		return ERR_ONLY_SUPPORT_HEARTBEAT_MSG
+		return "", ERR_ONLY_SUPPORT_HEARTBEAT_MSG
 	}
+	heartBeatRttSeconds.WithLabelValues(strings.Split(conn.RemoteAddr().String(), ":")[0]).Observe(time.Since(start).Seconds())
+	log.Logger.Debug("server:%s negotiated hash algo:%s", conn.RemoteAddr().String(), msg.GetHashAlgo())
 
-	return nil
-}
-
-func getDestFile(filename string) string {
-	for _, dir := range config.GClientConf.SyncDirs {
-		if strings.Contains(filename, dir.ServerDirName) {
-			// server is windows
-			if strings.Contains(dir.ServerDirName, "\\") {
-				// client is windows
-				if strings.Contains(dir.LocalDirName, "\\") {
-					return dir.LocalDirName + "\\" + strings.TrimPrefix(filename, dir.ServerDirName)
-				} else {
-					return filepath.Join(dir.LocalDirName, strings.Replace(strings.TrimLeft(filename, dir.ServerDirName), "\\", "/", -1))
-				}
-			} else {
-				// client is windows
-				if strings.Contains(dir.LocalDirName, "\\") {
-					return dir.LocalDirName + "\\" + strings.Replace(strings.TrimPrefix(filename, dir.ServerDirName), "/", "\\", -1)
-				} else {
-					return filepath.Join(dir.LocalDirName, strings.TrimPrefix(filename, dir.ServerDirName))
-				}
-			}
-		}
-	}
-	return ""
+	return msg.GetNonce(), nil
 }
 
-func createFile(filename string, dirFlag uint32) error {
-	tmpFile := getDestFile(filename)
-	if tmpFile == "" {
-		return fmt.Errorf("not found dest file by req file:%s", filename)
-	}
+func createFile(tmpFile string, dirFlag uint32) error {
 	if dirFlag == syncproto.PROTO_DIR_LEN {
 		log.Logger.Info("now MkdirAll:%s", tmpFile)
 		return os.MkdirAll(tmpFile, os.ModePerm)
@@ -125,47 +158,108 @@ func createFile(filename string, dirFlag uint32) error {
 	return nil
 }
 
-func writeFile(filename string, contentLen uint32, data []byte) error {
-	tmpFile := getDestFile(filename)
-	if tmpFile == "" {
-		return fmt.Errorf("not found dest file by req file:%s", filename)
+func writeFile(tmpFile string, contentLen uint32, hashAlgo, fileHash string, data []byte) error {
+	if uint32(len(data)) != contentLen {
+		return fmt.Errorf("contentLen:%d,recv len:%d,not equal", contentLen, len(data))
+	}
+	if fileHash != "" {
+		dataHash, err := common.GetDataHash(hashAlgo, data)
+		if err != nil {
+			return err
+		}
+		if dataHash != fileHash {
+			return fmt.Errorf("file:%s %s:%s,recv data %s:%s,not equal", tmpFile, hashAlgo, fileHash, hashAlgo, dataHash)
+		}
 	}
 	log.Logger.Info("now OpenFile(write):%s", tmpFile)
 	os.MkdirAll(filepath.Dir(tmpFile), os.ModePerm)
-	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	// write to a temp file in the same dir then rename it over the dest file,
+	// so readers never see a truncated file and a crash never leaves garbage
+	f, err := ioutil.TempFile(filepath.Dir(tmpFile), TMP_FILE_PREFIX+filepath.Base(tmpFile)+".")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	// temp file is created with 0600,keep mode of file replaced
+	mode := common.GetNewFileMode()
+	if fi, err := os.Stat(tmpFile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	err = os.Chmod(tmpName, mode)
 	if err != nil {
+		os.Remove(tmpName)
 		return err
 	}
-	defer f.Close()
-	n, err := f.Write(data)
+	err = backupFile(tmpFile, false)
 	if err != nil {
+		os.Remove(tmpName)
 		return err
 	}
-	if uint32(n) != contentLen {
-		return fmt.Errorf("contentLen:%d,write len:%d,not equal", contentLen, n)
+	err = os.Rename(tmpName, tmpFile)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	err = common.SyncDir(filepath.Dir(tmpFile))
+	if err != nil {
+		log.Logger.Warn("sync dir of file:%s failed,err:%s", tmpFile, err.Error())
+	}
+	if fileHash != "" {
+		common.GHashCache.PutFileHash(hashAlgo, tmpFile, fileHash)
+	} else {
+		common.GHashCache.Invalidate(tmpFile)
 	}
 	return nil
 }
 
-func removeFile(filename string) error {
-	tmpFile := getDestFile(filename)
-	if tmpFile == "" {
-		return fmt.Errorf("not found dest file by req file:%s", filename)
+// CleanTempFiles remove temp files left by writeFile when client exit abnormally
+func CleanTempFiles() {
+	for _, dir := range config.GetClientConf().SyncDirs {
+		filepath.Walk(dir.LocalDirName, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !info.IsDir() && strings.HasPrefix(info.Name(), TMP_FILE_PREFIX) {
+				log.Logger.Info("remove temp file:%s", path)
+				os.Remove(path)
+			}
+			return nil
+		})
 	}
-	log.Logger.Info("now RemoveAll:%s", tmpFile)
-	return os.RemoveAll(tmpFile)
 }
 
-func renameFile(srcFile, dstFile string) error {
-	tmpFile := getDestFile(srcFile)
-	if tmpFile == "" {
-		return fmt.Errorf("not found dest file by req file:%s", srcFile)
+func removeFile(tmpFile string) error {
+	log.Logger.Info("now RemoveAll:%s", tmpFile)
+	common.GHashCache.Invalidate(tmpFile)
+	err := backupFile(tmpFile, true)
+	if err != nil {
+		return err
 	}
+	return os.RemoveAll(tmpFile)
+}
 
+func renameFile(tmpFile, dstFile string) error {
 	fi, err := os.Stat(tmpFile)
 	if err != nil {
 		return err
 	}
+	common.GHashCache.Invalidate(tmpFile)
+	err = backupFile(tmpFile, true)
+	if err != nil {
+		return err
+	}
 	if fi.IsDir() {
 		log.Logger.Info("now rename:%s is dir,removeall", tmpFile)
 		return os.RemoveAll(tmpFile)
@@ -180,18 +274,105 @@ func chmodFile(filename string, mode int) error {
 	return nil
 }
 
-func fileExist(filename, fileMd5 string, contentLen uint32) error {
-	tmpFile := getDestFile(filename)
-	os.MkdirAll(filepath.Dir(tmpFile), os.ModePerm)
-	fileLen, md5, err := common.GetFileInfo(tmpFile)
+func fileExist(tmpFile, hashAlgo, fileHash string, contentLen uint32) error {
+	if !common.DryRun {
+		os.MkdirAll(filepath.Dir(tmpFile), os.ModePerm)
+	}
+	fileLen, tmpHash, err := common.GHashCache.GetFileHash(hashAlgo, tmpFile)
+	if err != nil {
+		return err
+	}
+	if uint32(fileLen) == contentLen && tmpHash == fileHash {
+		return nil
+	}
+	return fmt.Errorf("server file %s:%s,len:%d not equl client file:%s,%s:%s,len:%d",
+		hashAlgo, fileHash, contentLen, tmpFile, hashAlgo, tmpHash, fileLen)
+}
+
+// return hash algo and file hash of msg,fall back to md5 for old server
+func getMsgHash(msg *syncproto.FileSyncProto) (string, string) {
+	if msg.GetFileHash() != "" {
+		return msg.GetHashAlgo(), msg.GetFileHash()
+	}
+	return common.HASH_ALGO_MD5, msg.GetFileMd5()
+}
+
+// return hash algos announced to server in heartbeat,md5 is always supported
+func getHashAlgos() string {
+	switch config.GetClientConf().HashAlgo {
+	case "":
+		return strings.Join(common.SupportHashAlgos, ",")
+	case common.HASH_ALGO_MD5:
+		return common.HASH_ALGO_MD5
+	default:
+		return config.GetClientConf().HashAlgo + "," + common.HASH_ALGO_MD5
+	}
+}
+
+func processFileMsg(serverIp string, msg *syncproto.FileSyncProto) error {
+	destFile, err := getMsgDestFile(serverIp, msg)
 	if err != nil {
 		return err
 	}
-	if uint32(fileLen) == contentLen && md5 == fileMd5 {
+	return applyFileMsg(destFile, msg)
+}
+
+// applyFileMsg apply file msg to dest file
+func applyFileMsg(destFile string, msg *syncproto.FileSyncProto) error {
+	if common.DryRun && msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+		dryRunFileMsg(destFile, msg)
 		return nil
 	}
-	return fmt.Errorf("server file:%s,md5:%s,len:%d not equl client file:%s,md5:%s,len:%d",
-		filename, fileMd5, contentLen, tmpFile, md5, fileLen)
+	// changes made by us are not drift
+	markApplied(destFile)
+	defer markApplied(destFile)
+	hashAlgo, fileHash := getMsgHash(msg)
+	if !isAuditMsg(msg.GetMsgType()) {
+		return doFileMsg(destFile, msg, hashAlgo, fileHash)
+	}
+	oldHash := getAuditHash(destFile, hashAlgo)
+	err := doFileMsg(destFile, msg, hashAlgo, fileHash)
+	auditFileMsg(destFile, msg, hashAlgo, oldHash, err)
+	return err
+}
+
+func doFileMsg(destFile string, msg *syncproto.FileSyncProto, hashAlgo, fileHash string) error {
+	switch msg.GetMsgType() {
+	case syncproto.PROTO_MSG_FILE_CREATE_REQ:
+		return createFile(destFile, msg.GetContentLen())
+	case syncproto.PROTO_MSG_FILE_WRITE_REQ:
+		return writeFile(destFile, msg.GetContentLen(), hashAlgo, fileHash, msg.GetContent())
+	case syncproto.PROTO_MSG_FILE_REMOVE_REQ:
+		return removeFile(destFile)
+	case syncproto.PROTO_MSG_FILE_RENAME_REQ:
+		return renameFile(destFile, "dstFile")
+	case syncproto.PROTO_MSG_FILE_CHMOD_REQ:
+		return chmodFile(destFile, 0)
+	case syncproto.PROTO_MSG_FILE_EXIST_REQ:
+		return fileExist(destFile, hashAlgo, fileHash, msg.GetContentLen())
+	}
+	return fmt.Errorf("unsupport msgtype:%d", msg.GetMsgType())
+}
+
+// dryRunFileMsg log what would be done for msg without touching disk
+func dryRunFileMsg(destFile string, msg *syncproto.FileSyncProto) {
+	switch msg.GetMsgType() {
+	case syncproto.PROTO_MSG_FILE_CREATE_REQ:
+		if msg.GetContentLen() == syncproto.PROTO_DIR_LEN {
+			log.Logger.Info("dry-run: would MkdirAll:%s", destFile)
+		} else {
+			log.Logger.Info("dry-run: would create empty file:%s", destFile)
+		}
+	case syncproto.PROTO_MSG_FILE_WRITE_REQ:
+		log.Logger.Info("dry-run: would write %d bytes to file:%s", len(msg.GetContent()), destFile)
+	case syncproto.PROTO_MSG_FILE_REMOVE_REQ:
+		log.Logger.Info("dry-run: would RemoveAll:%s", destFile)
+	case syncproto.PROTO_MSG_FILE_RENAME_REQ:
+		log.Logger.Info("dry-run: would remove renamed file:%s", destFile)
+	default:
+		log.Logger.Info("dry-run: would %s:%s", syncproto.GetMsgName(msg.GetMsgType()), destFile)
+	}
+	common.DryRunRecord(syncproto.GetMsgName(msg.GetMsgType()), len(msg.GetContent()))
 }
 
 func ProcessServer(conn net.Conn) error {
@@ -210,27 +391,45 @@ func ProcessServer(conn net.Conn) error {
 	}
 	syncproto.LogMsg(conn, msg)
 
+	respMsg := applyServerMsg(strings.Split(clientAddr, ":")[0], msg)
+	if respMsg == nil {
+		return fmt.Errorf("unsupport msgtype:%d", msg.GetMsgType())
+	}
+	respData, err := proto.Marshal(respMsg)
+	if err != nil {
+		log.Logger.Warn("proto.Marshal heartbeat res msg failed,err:%s", err.Error())
+		return err
+	}
+	err = common.WriteMsg(respData, conn)
+	if err != nil {
+		log.Logger.Warn("WriteMsg failed,err:%s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// applyServerMsg apply msg from server and return response,nil if msg is not supported
+func applyServerMsg(serverIp string, msg *syncproto.FileSyncProto) *syncproto.FileSyncProto {
 	respMsg := &syncproto.FileSyncProto{
 		Version:    proto.Uint32(syncproto.PROTO_VERSION),
 		ContentLen: proto.Uint32(0),
 	}
 
 	var cmdErr error
+	start := time.Now()
 	switch msg.GetMsgType() {
-	case syncproto.PROTO_MSG_FILE_CREATE_REQ:
-		cmdErr = createFile(msg.GetFileName(), msg.GetContentLen())
-	case syncproto.PROTO_MSG_FILE_WRITE_REQ:
-		cmdErr = writeFile(msg.GetFileName(), msg.GetContentLen(), msg.GetContent())
-	case syncproto.PROTO_MSG_FILE_REMOVE_REQ:
-		cmdErr = removeFile(msg.GetFileName())
-	case syncproto.PROTO_MSG_FILE_RENAME_REQ:
-		cmdErr = renameFile(msg.GetFileName(), "dstFile")
-	case syncproto.PROTO_MSG_FILE_CHMOD_REQ:
-		cmdErr = chmodFile(msg.GetFileName(), 0)
-	case syncproto.PROTO_MSG_FILE_EXIST_REQ:
-		cmdErr = fileExist(msg.GetFileName(), msg.GetFileMd5(), msg.GetContentLen())
+	case syncproto.PROTO_MSG_FILE_CREATE_REQ, syncproto.PROTO_MSG_FILE_WRITE_REQ, syncproto.PROTO_MSG_FILE_REMOVE_REQ,
+		syncproto.PROTO_MSG_FILE_RENAME_REQ, syncproto.PROTO_MSG_FILE_CHMOD_REQ, syncproto.PROTO_MSG_FILE_EXIST_REQ:
+		cmdErr = processFileMsg(serverIp, msg)
+	case syncproto.PROTO_MSG_SNAPSHOT_REQ:
+		cmdErr = processSnapshotMsg(serverIp, msg)
 	default:
-		return fmt.Errorf("unsupport msgtype:%d", msg.GetMsgType())
+		return nil
+	}
+	observeMsgApplied(msg, start, cmdErr)
+	if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+		syncproto.LogMsgJson("apply", serverIp, msg, start, cmdErr)
 	}
 
 	if cmdErr == nil {
@@ -243,16 +442,5 @@ func ProcessServer(conn net.Conn) error {
 		}
 		respMsg.MsgType = proto.Uint32(syncproto.PROTO_MSG_COMMON_RESP_FAIL)
 	}
-	respData, err := proto.Marshal(respMsg)
-	if err != nil {
-		log.Logger.Warn("proto.Marshal heartbeat res msg failed,err:%s", err.Error())
-		return err
-	}
-	err = common.WriteMsg(respData, conn)
-	if err != nil {
-		log.Logger.Warn("WriteMsg failed,err:%s", err.Error())
-		return err
-	}
-
-	return nil
+	return respMsg
 }
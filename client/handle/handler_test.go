@@ -1,10 +1,21 @@
 package handle
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
 )
 
 type S1 struct {
@@ -78,3 +89,613 @@ func TestGetDestFile(t *testing.T) {
 	}
 	fmt.Printf("---\n")
 }
+
+func TestWriteFile(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, ServerAddr: "192.168.1.104:9090"},
+	}
+
+	data := []byte("hello world.")
+	fileHash, _ := common.GetDataHash(common.HASH_ALGO_SHA256, data)
+	msg := &syncproto.FileSyncProto{
+		Version:    proto.Uint32(syncproto.PROTO_VERSION),
+		MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+		RootName:   proto.String("/home/server/src"),
+		RelPath:    proto.String("a/b.txt"),
+		ContentLen: proto.Uint32(uint32(len(data))),
+		Content:    data,
+		HashAlgo:   proto.String(common.HASH_ALGO_SHA256),
+		FileHash:   proto.String(fileHash),
+	}
+	err = processFileMsg("192.168.1.104", msg)
+	if err != nil {
+		t.Fatalf("processFileMsg failed,err:%s", err.Error())
+	}
+	content, err := ioutil.ReadFile(filepath.Join(localDir, "a", "b.txt"))
+	if err != nil || string(content) != string(data) {
+		t.Fatalf("read dest file failed,content:%s", content)
+	}
+	// new file gets default mode,replaced file keeps its mode
+	destFile := filepath.Join(localDir, "a", "b.txt")
+	if fi, _ := os.Stat(destFile); runtime.GOOS != "windows" && fi.Mode().Perm() != common.GetNewFileMode() {
+		t.Fatalf("mode of new file is %v", fi.Mode())
+	}
+	os.Chmod(destFile, 0640)
+	writeFile(destFile, uint32(len(data)), "", "", data)
+	if fi, _ := os.Stat(destFile); runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Fatalf("mode of replaced file is %v", fi.Mode())
+	}
+
+	err = writeFile(filepath.Join(localDir, "a", "b.txt"), uint32(len(data)), common.HASH_ALGO_MD5, "badmd5", []byte("bad content."))
+	if err == nil {
+		t.Fatalf("writeFile with bad md5 should failed")
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(localDir, "a", "b.txt"))
+	if string(content) != string(data) {
+		t.Fatalf("dest file changed after failed write,content:%s", content)
+	}
+
+	ioutil.WriteFile(filepath.Join(localDir, "a", TMP_FILE_PREFIX+"b.txt.123"), data, os.ModePerm)
+	CleanTempFiles()
+	files, _ := ioutil.ReadDir(filepath.Join(localDir, "a"))
+	if len(files) != 1 {
+		t.Fatalf("temp file not cleaned,file num:%d", len(files))
+	}
+}
+
+func TestGetDestFileStrict(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	outDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(outDir)
+	err = os.Symlink(outDir, filepath.Join(localDir, "link"))
+	if err != nil {
+		t.Fatalf("Symlink failed,err:%s", err.Error())
+	}
+
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, ServerAddr: "192.168.1.104:9090"},
+		{ServerDirName: "/home/server/src/sub", LocalDirName: "/letv/sub", ServerAddr: "192.168.1.104:9090"},
+		{ServerDirName: "E:\\Tools\\", LocalDirName: "/letv/mysrc", ServerAddr: "192.168.1.104:9090"},
+		{ServerDirName: "E:\\WorkCode\\src\\", LocalDirName: "E:\\WorkCodeBak\\src", ServerAddr: "192.168.1.104:9090"},
+	}
+	cases := []struct {
+		filename string
+		want     string
+		ok       bool
+	}{
+		{"/home/server/src/mygo/my.go", filepath.Join(localDir, "mygo", "my.go"), true},
+		{"/home/server/src//mygo/my.go", filepath.Join(localDir, "mygo", "my.go"), true},
+		{"/home/server/src/sub/my.go", "/letv/sub/my.go", true},
+		{"/home/server/src2/my.go", "", false},
+		{"/home/server/srcmy.go", "", false},
+		{"/tmp/home/server/src/my.go", "", false},
+		{"/home/server/src", "", false},
+		{"/home/server/src/../etc/passwd", "", false},
+		{"/home/server/src/mygo/../../etc/passwd", "", false},
+		{"/home/server/src/link/passwd", "", false},
+		{"/home/server/src/link", "", false},
+		{"E:\\Tools\\goenv\\errcheck.zip", "/letv/mysrc/goenv/errcheck.zip", true},
+		{"E:\\Tools\\..\\Windows\\win.ini", "", false},
+		{"E:\\Tools\\C:\\Windows\\win.ini", "", false},
+		{"E:\\WorkCode\\src\\go\\a.go", "E:\\WorkCodeBak\\src\\go\\a.go", true},
+		{"E:\\WorkCode\\src\\go\\..\\..\\a.go", "", false},
+	}
+	for _, c := range cases {
+		file, err := getDestFile("192.168.1.104", c.filename)
+		if c.ok && (err != nil || file != c.want) {
+			t.Fatalf("getDestFile(%s) is %s,err:%v,want %s", c.filename, file, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("getDestFile(%s) is %s,want error", c.filename, file)
+		}
+	}
+}
+
+func TestGetMsgDestFile(t *testing.T) {
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{Root: "code", ServerDirName: "/home/server/src/", LocalDirName: "/letv/server1", ServerAddr: "192.168.1.104:9090",
+			VersionsDir: "/letv/server1/.versions", SnapshotDir: "/letv/server1/.snapshots"},
+		{Root: "code", ServerDirName: "E:\\MyCode", LocalDirName: "/letv/server2", ServerAddr: "192.168.1.105:9090"},
+		{ServerDirName: "E:\\MyCode\\", LocalDirName: "/letv/server2/all", ServerAddr: "192.168.1.105:9090"},
+	}
+	cases := []struct {
+		serverIp string
+		root     string
+		relPath  string
+		want     string
+		ok       bool
+	}{
+		{"192.168.1.104", "code", "a/b.go", "/letv/server1/a/b.go", true},
+		{"192.168.1.105", "code", "a/b.go", "/letv/server2/a/b.go", true},
+		{"192.168.1.105", "E:/MyCode", "a/b.go", "/letv/server2/all/a/b.go", true},
+		{"192.168.1.104", "E:/MyCode", "a/b.go", "", false},
+		{"192.168.1.106", "code", "a/b.go", "", false},
+		{"192.168.1.104", "code", "../b.go", "", false},
+		{"192.168.1.104", "code", "/etc/passwd", "", false},
+		{"192.168.1.104", "code", "..\\..\\Windows\\x", "", false},
+		{"192.168.1.104", "code", "a\\..\\..\\x", "", false},
+		{"192.168.1.104", "code", "C:foo", "", false},
+		{"192.168.1.104", "code", ".versions/a/b.go~1", "", false},
+		{"192.168.1.104", "code", ".snapshots", "", false},
+		{"192.168.1.104", "code", ".versions2/b.go", "/letv/server1/.versions2/b.go", true},
+		{"192.168.1.104", "code", "//server/share/x", "", false},
+		{"192.168.1.104", "code", "\\\\server\\share\\x", "", false},
+	}
+	for _, c := range cases {
+		msg := &syncproto.FileSyncProto{
+			RootName: proto.String(c.root),
+			RelPath:  proto.String(c.relPath),
+		}
+		file, err := getMsgDestFile(c.serverIp, msg)
+		if c.ok && (err != nil || file != c.want) {
+			t.Fatalf("getMsgDestFile(%s,%s,%s) is %s,err:%v,want %s", c.serverIp, c.root, c.relPath, file, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("getMsgDestFile(%s,%s,%s) is %s,want error", c.serverIp, c.root, c.relPath, file)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	localDir := filepath.Join(tmpDir, "local")
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, VersionsDir: filepath.Join(tmpDir, "versions"), VersionsKeep: 2},
+	}
+
+	destFile := filepath.Join(localDir, "a", "b.txt")
+	for _, data := range []string{"v1", "v2", "v3", "v4"} {
+		err = writeFile(destFile, uint32(len(data)), "", "", []byte(data))
+		if err != nil {
+			t.Fatalf("writeFile failed,err:%s", err.Error())
+		}
+	}
+	versions, err := ListVersions(destFile)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("ListVersions failed,versions:%v,err:%v", versions, err)
+	}
+	err = RestoreVersion(destFile, versions[1])
+	if err != nil {
+		t.Fatalf("RestoreVersion failed,err:%s", err.Error())
+	}
+	content, _ := ioutil.ReadFile(destFile)
+	if string(content) != "v2" {
+		t.Fatalf("restored content is %s,want v2", content)
+	}
+	if !isApplied(destFile) {
+		t.Fatalf("restored file should not be drift")
+	}
+
+	err = removeFile(filepath.Join(localDir, "a"))
+	if err != nil {
+		t.Fatalf("removeFile failed,err:%s", err.Error())
+	}
+	versions, _ = ListVersions(destFile)
+	if len(versions) != 2 {
+		t.Fatalf("versions after remove:%v", versions)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(tmpDir, "versions", "a", "b.txt"+VERSION_SEP+versions[0]))
+	if string(content) != "v2" {
+		t.Fatalf("newest version content is %s,want v2", content)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	localDir := filepath.Join(tmpDir, "local")
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, SnapshotDir: filepath.Join(localDir, ".snapshots"),
+			VersionsDir: filepath.Join(localDir, ".versions")},
+	}
+	destFile := filepath.Join(localDir, "a", "b.txt")
+	err = writeFile(destFile, uint32(len("v1")), "", "", []byte("v1"))
+	if err != nil {
+		t.Fatalf("writeFile failed,err:%s", err.Error())
+	}
+	versionFile := filepath.Join(localDir, ".versions", "v.txt")
+	os.MkdirAll(filepath.Dir(versionFile), os.ModePerm)
+	err = ioutil.WriteFile(versionFile, []byte("v"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed,err:%s", err.Error())
+	}
+	snapshot, err := TakeLocalSnapshot(localDir)
+	if err != nil {
+		t.Fatalf("TakeLocalSnapshot failed,err:%s", err.Error())
+	}
+
+	// file changed in place does not change snapshot
+	err = ioutil.WriteFile(destFile, []byte("v2"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed,err:%s", err.Error())
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(localDir, ".snapshots", snapshot, "a", "b.txt"))
+	if string(content) != "v1" {
+		t.Fatalf("snapshot content is %s,want v1", content)
+	}
+	err = writeFile(filepath.Join(localDir, "c.txt"), uint32(len("c")), "", "", []byte("c"))
+	if err != nil {
+		t.Fatalf("writeFile failed,err:%s", err.Error())
+	}
+	// snapshots in the same second have different names
+	snapshot2, err := TakeLocalSnapshot(localDir)
+	if err != nil {
+		t.Fatalf("TakeLocalSnapshot failed,err:%s", err.Error())
+	}
+	snapshots, _ := getSnapshots(config.GetClientConf().SyncDirs[0])
+	if snapshot2 == snapshot || len(snapshots) != 2 || snapshots[0] != snapshot2 {
+		t.Fatalf("snapshots are %v,want %s first", snapshots, snapshot2)
+	}
+	err = RestoreSnapshot(localDir, snapshot)
+	if err != nil {
+		t.Fatalf("RestoreSnapshot failed,err:%s", err.Error())
+	}
+	content, _ = ioutil.ReadFile(destFile)
+	if string(content) != "v1" {
+		t.Fatalf("restored content is %s,want v1", content)
+	}
+	_, err = os.Stat(filepath.Join(localDir, "c.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("file not in snapshot is not removed,err:%v", err)
+	}
+	if !isApplied(destFile) || !isApplied(filepath.Join(localDir, "c.txt")) || isApplied(filepath.Join(localDir, "d.txt")) {
+		t.Fatalf("only restored files should not be drift")
+	}
+	// internal dirs under local_dir are kept
+	_, err = os.Stat(versionFile)
+	if err != nil {
+		t.Fatalf("versions are removed by restore,err:%s", err.Error())
+	}
+	_, err = os.Stat(filepath.Join(localDir, ".snapshots", snapshot2))
+	if err != nil {
+		t.Fatalf("snapshots are removed by restore,err:%s", err.Error())
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, ServerAddr: "192.168.1.104:9090"},
+	}
+	common.DryRun = true
+	defer func() { common.DryRun = false }()
+
+	data := []byte("hello world.")
+	msg := &syncproto.FileSyncProto{
+		Version:    proto.Uint32(syncproto.PROTO_VERSION),
+		MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+		RootName:   proto.String("/home/server/src"),
+		RelPath:    proto.String("a/b.txt"),
+		ContentLen: proto.Uint32(uint32(len(data))),
+		Content:    data,
+	}
+	err = processFileMsg("192.168.1.104", msg)
+	if err != nil {
+		t.Fatalf("processFileMsg failed,err:%s", err.Error())
+	}
+	// exist msg is processed in dry run
+	msg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_EXIST_REQ)
+	processFileMsg("192.168.1.104", msg)
+	_, err = os.Stat(filepath.Join(localDir, "a"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("dry run should not touch disk,err:%v", err)
+	}
+	summary := common.DryRunSummary()
+	if !strings.Contains(summary, "(12 bytes)") {
+		t.Fatalf("summary is %s", summary)
+	}
+}
+
+func TestSyncFromDir(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(srcDir)
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	os.MkdirAll(filepath.Join(srcDir, "a", "c"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(srcDir, "a", "b.txt"), []byte("hello world."), 0644)
+	ioutil.WriteFile(filepath.Join(srcDir, "d.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(localDir, "d.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(localDir, "e.txt"), []byte("kept"), 0644)
+	config.GetClientConf().SyncDirs = nil
+
+	result, err := SyncFromDir(srcDir, &config.FileSyncConf{LocalDirName: localDir})
+	if err != nil {
+		t.Fatalf("SyncFromDir failed,err:%s", err.Error())
+	}
+	if result.Created != 2 || result.Written != 1 || result.Unchanged != 1 || result.Failed != 0 || result.Bytes != 12 {
+		t.Fatalf("sync result is %s", result.String())
+	}
+	content, err := ioutil.ReadFile(filepath.Join(localDir, "a", "b.txt"))
+	if err != nil || string(content) != "hello world." {
+		t.Fatalf("read synced file failed,content:%s", content)
+	}
+	_, err = os.Stat(filepath.Join(localDir, "e.txt"))
+	if err != nil {
+		t.Fatalf("local file not in src should be kept,err:%s", err.Error())
+	}
+	result, err = SyncFromDir(srcDir, &config.FileSyncConf{LocalDirName: localDir})
+	if err != nil || result.Unchanged != 4 {
+		t.Fatalf("sync again result is %v,err:%v", result, err)
+	}
+}
+
+func TestDiffLocalDir(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	os.MkdirAll(filepath.Join(localDir, "a"), os.ModePerm)
+	os.MkdirAll(filepath.Join(localDir, "x", "y"), os.ModePerm)
+	os.MkdirAll(filepath.Join(localDir, ".versions"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(localDir, "a", "b.txt"), []byte("hello world."), 0644)
+	ioutil.WriteFile(filepath.Join(localDir, "a", "c.txt"), []byte("changed"), 0644)
+	ioutil.WriteFile(filepath.Join(localDir, ".versions", "a~1"), []byte("old"), 0644)
+	dir := &config.FileSyncConf{LocalDirName: localDir, VersionsDir: filepath.Join(localDir, ".versions")}
+
+	hash := func(data string) string {
+		fileHash, _ := common.GetDataHash(common.HASH_ALGO_MD5, []byte(data))
+		return fileHash
+	}
+	entries := []*syncproto.ListEntry{
+		{Path: "a", Dir: true},
+		{Path: "a/b.txt", Len: 12, Hash: hash("hello world.")},
+		{Path: "a/c.txt", Len: 8, Hash: hash("original")},
+		{Path: "a/d.txt", Len: 4, Hash: hash("lost")},
+	}
+	result, err := diffLocalDir(dir, entries, common.HASH_ALGO_MD5)
+	if err != nil {
+		t.Fatalf("diffLocalDir failed,err:%s", err.Error())
+	}
+	if strings.Join(result.Missing, ",") != "a/d.txt" || strings.Join(result.Extra, ",") != "x" ||
+		strings.Join(result.Differ, ",") != "a/c.txt" || result.IsSame() {
+		t.Fatalf("verify result is %v", result)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{ServerDirName: "/home/server/src/", LocalDirName: localDir, ServerAddr: "192.168.1.104:9090"},
+	}
+	auditFile := filepath.Join(localDir, "audit.log")
+	err = OpenAuditLog(auditFile)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed,err:%s", err.Error())
+	}
+	defer func() {
+		auditLog.Close()
+		auditLog = nil
+	}()
+
+	for _, data := range []string{"old", "new"} {
+		msg := &syncproto.FileSyncProto{
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+			RootName:   proto.String("/home/server/src"),
+			RelPath:    proto.String("a.txt"),
+			ContentLen: proto.Uint32(uint32(len(data))),
+			Content:    []byte(data),
+		}
+		err = processFileMsg("192.168.1.104", msg)
+		if err != nil {
+			t.Fatalf("processFileMsg failed,err:%s", err.Error())
+		}
+	}
+	content, err := ioutil.ReadFile(auditFile)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if err != nil || len(lines) != 2 {
+		t.Fatalf("audit log is %s,err:%v", content, err)
+	}
+	record := make(map[string]interface{})
+	err = json.Unmarshal([]byte(lines[1]), &record)
+	oldHash, _ := common.GetDataHash(common.HASH_ALGO_MD5, []byte("old"))
+	newHash, _ := common.GetDataHash(common.HASH_ALGO_MD5, []byte("new"))
+	if err != nil || record["op"] != "writeReq" || record["path"] != "a.txt" || record["old_hash"] != oldHash || record["hash"] != newHash {
+		t.Fatalf("audit record is %s,err:%v", lines[1], err)
+	}
+}
+
+func TestRunners(t *testing.T) {
+	r := newRunners()
+	started := make(chan string, 10)
+	stopped := make(chan string, 10)
+	newRun := func(key string) func(stop chan bool) {
+		return func(stop chan bool) {
+			started <- key
+			<-stop
+			stopped <- key
+		}
+	}
+	r.update(map[string]func(stop chan bool){"a": newRun("a"), "b": newRun("b")})
+	r.update(map[string]func(stop chan bool){"b": newRun("b"), "c": newRun("c")})
+	keys := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case key := <-started:
+			keys[key] = true
+		case <-time.After(time.Second):
+			t.Fatalf("runners started:%v", keys)
+		}
+	}
+	if !keys["a"] || !keys["b"] || !keys["c"] {
+		t.Fatalf("runners started:%v", keys)
+	}
+	select {
+	case key := <-stopped:
+		if key != "a" {
+			t.Fatalf("runner:%s should not be stopped", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("runner a is not stopped")
+	}
+	r.stop()
+	r.wait()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("runners are not stopped")
+		}
+	}
+	// nothing is started after stop
+	r.update(map[string]func(stop chan bool){"d": newRun("d")})
+	select {
+	case key := <-started:
+		t.Fatalf("runner:%s started after stop", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNewHeartBeatMsg(t *testing.T) {
+	config.GetClientConf().ClientId = "web-01"
+	config.GetClientConf().ClientSecret = "secret1"
+	config.GetClientConf().ListenAddr = "0.0.0.0:9091"
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{Root: "code", LocalDirName: "/letv/code", ServerAddr: "192.168.1.104"},
+		{Root: "docs", LocalDirName: "/letv/docs", ServerAddr: "192.168.1.104:6001", SnapshotDir: "/letv/snapshots"},
+		{Root: "code", LocalDirName: "/letv/code2", ServerAddr: "192.168.1.105:6001"},
+	}
+	defer func() {
+		config.GetClientConf().ClientId = ""
+		config.GetClientConf().ClientSecret = ""
+		config.GetClientConf().ListenAddr = ""
+		config.GetClientConf().SyncDirs = nil
+	}()
+	msg := newHeartBeatMsg(syncproto.PROTO_MSG_HEART_BETA_REQ, "192.168.1.104:6001", "")
+	if msg.GetClientId() != "web-01" || msg.GetListenAddr() != "0.0.0.0:9091" || msg.Token != nil ||
+		strings.Join(msg.GetRoots(), ",") != "code,docs" || strings.Join(msg.GetCaps(), ",") != syncproto.CAP_SNAPSHOT {
+		t.Fatalf("heartbeat msg is %s", msg.String())
+	}
+	// token is signed with nonce of conn once server sent it
+	msg = newHeartBeatMsg(syncproto.PROTO_MSG_HEART_BETA_REQ, "192.168.1.105:6001", "nonce1")
+	if strings.Join(msg.GetRoots(), ",") != "code" || len(msg.GetCaps()) != 0 ||
+		!common.CheckClientToken("secret1", "web-01", "nonce1", msg.GetToken()) {
+		t.Fatalf("heartbeat msg is %s", msg.String())
+	}
+}
+
+func TestIsInternalPath(t *testing.T) {
+	dir := &config.FileSyncConf{LocalDirName: "/letv/code", QuarantineDir: "/letv/code/.quarantine/", VersionsDir: "/letv/code/./.versions"}
+	cases := map[string]bool{
+		"/letv/code/.quarantine":          true,
+		"/letv/code/.quarantine/a.go.123": true,
+		"/letv/code/.versions/a.go~1":     true,
+		"/letv/code/a/../.versions/b":     true,
+		"/letv/code/.quarantine2/a.go":    false,
+		"/letv/code/a.go":                 false,
+	}
+	for filename, want := range cases {
+		if dir.IsInternalPath(filepath.FromSlash(filename)) != want {
+			t.Fatalf("IsInternalPath(%s) should be %v", filename, want)
+		}
+	}
+}
+
+func TestGetHeartBeatAddr(t *testing.T) {
+	cases := []struct {
+		serverAddr string
+		port       int
+		want       string
+	}{
+		// port of server_addr is not the heartbeat port
+		{"192.168.1.104:9090", 0, "192.168.1.104:6001"},
+		{"192.168.1.104", 0, "192.168.1.104:6001"},
+		{"192.168.1.104:9090", 7001, "192.168.1.104:7001"},
+		{"server.local", 7001, "server.local:7001"},
+	}
+	for _, c := range cases {
+		dir := &config.FileSyncConf{ServerAddr: c.serverAddr, ServerHeartBeatPort: c.port}
+		if addr := dir.GetHeartBeatAddr(); addr != c.want {
+			t.Fatalf("GetHeartBeatAddr of %s,port:%d is %s,want %s", c.serverAddr, c.port, addr, c.want)
+		}
+	}
+}
+
+func TestServePushConnStop(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	config.GetClientConf().HeartBeatInterval = 10
+	// remote address of pipe is "pipe"
+	config.GetClientConf().SyncDirs = []*config.FileSyncConf{
+		{Root: "code", ServerDirName: "/home/server/src/", LocalDirName: localDir, ServerAddr: "pipe"},
+	}
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	stop := make(chan bool)
+	resps := make(chan *syncproto.FileSyncProto, 1)
+	go func() {
+		defer close(resps)
+		if _, err := common.ReadMsg(serverConn); err != nil {
+			return
+		}
+		data := []byte("pushed")
+		msgData, _ := proto.Marshal(&syncproto.FileSyncProto{
+			Version:    proto.Uint32(syncproto.PROTO_VERSION),
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+			RootName:   proto.String("code"),
+			RelPath:    proto.String("a.txt"),
+			ContentLen: proto.Uint32(uint32(len(data))),
+			Content:    data,
+			Seq:        proto.Uint32(1),
+		})
+		// pipe write returns after client read the msg,so it is being applied when stop
+		if common.WriteMsg(msgData, serverConn) != nil {
+			return
+		}
+		close(stop)
+		respData, err := common.ReadMsg(serverConn)
+		if err != nil {
+			return
+		}
+		resp := &syncproto.FileSyncProto{}
+		proto.Unmarshal(respData, resp)
+		resps <- resp
+	}()
+	if !servePushConn(&pushConn{conn: clientConn, serverAddr: "pipe:6001"}, stop) {
+		t.Fatalf("servePushConn should return true when stop")
+	}
+	resp, ok := <-resps
+	if !ok || resp.GetMsgType() != syncproto.PROTO_MSG_COMMON_RESP_OK || resp.GetSeq() != 1 {
+		t.Fatalf("pushed msg being applied is not answered before stop,resp:%v", resp)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(localDir, "a.txt"))
+	if string(content) != "pushed" {
+		t.Fatalf("pushed file content is %s", content)
+	}
+}
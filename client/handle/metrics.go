@@ -0,0 +1,48 @@
+package handle
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+var (
+	msgsReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_client_messages_received_total",
+		Help: "Messages received from servers,by type.",
+	}, []string{"type"})
+	msgsFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_client_messages_failed_total",
+		Help: "Messages failed to apply,by type.",
+	}, []string{"type"})
+	receivedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filesync_client_received_bytes_total",
+		Help: "File content bytes received from servers.",
+	})
+	applySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filesync_client_apply_seconds",
+		Help:    "Time to apply message from server,by type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+	heartBeatRttSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "filesync_client_heartbeat_rtt_seconds",
+		Help:    "Round trip time of heartbeat,by server.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"server"})
+)
+
+func init() {
+	prometheus.MustRegister(msgsReceivedTotal, msgsFailedTotal, receivedBytesTotal, applySeconds, heartBeatRttSeconds)
+}
+
+func observeMsgApplied(msg *syncproto.FileSyncProto, start time.Time, err error) {
+	msgName := syncproto.GetMsgName(msg.GetMsgType())
+	msgsReceivedTotal.WithLabelValues(msgName).Inc()
+	receivedBytesTotal.Add(float64(len(msg.GetContent())))
+	applySeconds.WithLabelValues(msgName).Observe(time.Since(start).Seconds())
+	// not exist is the expected answer of exist msg
+	if err != nil && msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+		msgsFailedTotal.WithLabelValues(msgName).Inc()
+	}
+}
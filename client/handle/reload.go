@@ -0,0 +1,113 @@
+package handle
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+)
+
+// runners are goroutines started by config,keyed by what they depend on,
+// so that only changed ones are restarted when reload
+type runners struct {
+	lock  sync.Mutex
+	stops map[string]chan bool
+	// set when shutdown,nothing is started after it
+	closed bool
+	wg     sync.WaitGroup
+}
+
+var (
+	heartBeatRunners = newRunners()
+	driftRunners     = newRunners()
+	snapshotRunners  = newRunners()
+
+	reloadLock = sync.Mutex{}
+)
+
+func newRunners() *runners {
+	return &runners{stops: make(map[string]chan bool)}
+}
+
+// update stop runners not in runs and start runs not running
+func (r *runners) update(runs map[string]func(stop chan bool)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	for key, stop := range r.stops {
+		if _, ok := runs[key]; !ok {
+			close(stop)
+			delete(r.stops, key)
+		}
+	}
+	for key, run := range runs {
+		if _, ok := r.stops[key]; ok {
+			continue
+		}
+		stop := make(chan bool)
+		r.stops[key] = stop
+		r.wg.Add(1)
+		go func(run func(stop chan bool), stop chan bool) {
+			defer r.wg.Done()
+			run(stop)
+		}(run, stop)
+	}
+}
+
+// stop stop all runners,update starts nothing after it
+func (r *runners) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	for key, stop := range r.stops {
+		close(stop)
+		delete(r.stops, key)
+	}
+}
+
+// wait wait stopped runners to exit
+func (r *runners) wait() {
+	r.wg.Wait()
+}
+
+// waitStop wait d,return true if stop is closed before
+func waitStop(stop chan bool, d time.Duration) bool {
+	select {
+	case <-stop:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// getDirKey return key of sync dir,which changes if any option of it changes
+func getDirKey(dir *config.FileSyncConf) string {
+	data, _ := json.Marshal(dir)
+	return string(data)
+}
+
+// Reload read config file again and apply it: heartbeats, drift watches and
+// snapshots of changed sync dirs are restarted. running config is kept if new one is invalid
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	newConf, err := config.ReloadConfig()
+	if err != nil {
+		log.Logger.Error("reload config:%s failed,keep running config,err:%s", config.ConfFileName, err.Error())
+		return err
+	}
+	config.SetClientConf(newConf)
+	StartHeartBeat()
+	StartDriftWatch()
+	// dry run change nothing on disk
+	if !common.DryRun {
+		StartSnapshots()
+	}
+	log.Logger.Info("reload config:%s ok", config.ConfFileName)
+	return nil
+}
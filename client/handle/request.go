@@ -0,0 +1,49 @@
+package handle
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+// requestServer send request msg of sync dir to its server and return response
+func requestServer(dir *config.FileSyncConf, msg *syncproto.FileSyncProto) (*syncproto.FileSyncProto, error) {
+	msg.Version = proto.Uint32(syncproto.PROTO_VERSION)
+	msg.RootName = proto.String(dir.GetRoot())
+	if msg.ContentLen == nil {
+		msg.ContentLen = proto.Uint32(0)
+	}
+	msgData, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", dir.GetHeartBeatAddr(), common.DIAL_TIMEOUT*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	syncproto.LogMsg(conn, msg)
+	err = common.WriteMsg(msgData, conn)
+	if err != nil {
+		return nil, err
+	}
+	msgData, err = common.ReadMsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	respMsg := &syncproto.FileSyncProto{}
+	err = proto.Unmarshal(msgData, respMsg)
+	if err != nil {
+		return nil, err
+	}
+	syncproto.LogMsg(conn, respMsg)
+	if respMsg.GetMsgType() == syncproto.PROTO_MSG_COMMON_RESP_FAIL {
+		return nil, fmt.Errorf("server:%s process %s failed", dir.ServerAddr, syncproto.GetMsgName(msg.GetMsgType()))
+	}
+	return respMsg, nil
+}
@@ -0,0 +1,43 @@
+package handle
+
+import (
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+)
+
+// Shutdown stop accepting msgs from servers,stop heartbeats,drift watches and snapshots,
+// then wait msgs being applied and runners to exit in timeout,return false if timeout.
+// file being written when timeout is left as temp file and cleaned at next start
+func Shutdown(timeout time.Duration) bool {
+	defer common.GJsonLog.Close()
+	defer auditLog.Close()
+	log.Logger.Info("shutdown,wait msgs being applied in %s", timeout.String())
+	deadline := time.Now().Add(timeout)
+	common.CloseListeners()
+	// single port clients apply msgs pushed on heartbeat conns till heartbeat runners exit
+	allRunners := []*runners{heartBeatRunners, driftRunners, snapshotRunners}
+	for _, r := range allRunners {
+		r.stop()
+	}
+	runnersDone := make(chan bool)
+	go func() {
+		for _, r := range allRunners {
+			r.wait()
+		}
+		close(runnersDone)
+	}()
+	if !common.WaitConns(time.Until(deadline)) {
+		log.Logger.Warn("shutdown,msgs being applied are not done in %s", timeout.String())
+		return false
+	}
+	select {
+	case <-runnersDone:
+	case <-time.After(time.Until(deadline)):
+		log.Logger.Warn("shutdown,heartbeats,drift watches and snapshots are not done in %s", timeout.String())
+		return false
+	}
+	log.Logger.Info("shutdown,all msgs are applied")
+	return true
+}
@@ -0,0 +1,136 @@
+package handle
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+// pushConn is heartbeat conn of single port client,server push msgs on it
+type pushConn struct {
+	conn net.Conn
+	// heartbeat address of server in config
+	serverAddr string
+	// guard writes of heartbeats and responses
+	writeLock sync.Mutex
+	// unix nano when last heartbeat is sent
+	heartBeatSent int64
+	// nonce of conn from last heartbeat response,heartbeats are signed with it
+	nonce atomic.Value
+}
+
+func (c *pushConn) getNonce() string {
+	nonce, _ := c.nonce.Load().(string)
+	return nonce
+}
+
+// singlePortLoop keep heartbeat conn with server and apply msgs pushed on it,
+// so client need not listen
+func singlePortLoop(serverHeartAddr string, stop chan bool) {
+	for {
+		conn, err := net.DialTimeout("tcp", serverHeartAddr, common.DIAL_TIMEOUT*time.Second)
+		if err != nil {
+			log.Logger.Error("Dial for heartbeat to server:%s failed,err:%s", serverHeartAddr, err.Error())
+			if waitStop(stop, time.Duration(config.GetClientConf().HeartBeatInterval)*time.Second) {
+				return
+			}
+			continue
+		}
+		if servePushConn(&pushConn{conn: conn, serverAddr: serverHeartAddr}, stop) {
+			log.Logger.Info("stop heartbeat with server:%s", serverHeartAddr)
+			return
+		}
+	}
+}
+
+// servePushConn send heartbeats and apply pushed msgs until conn fails,
+// return true if stop is closed after msg being applied is done
+func servePushConn(c *pushConn, stop chan bool) bool {
+	defer c.conn.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		c.readMsgs()
+	}()
+	for {
+		msgReq := newHeartBeatMsg(syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ, c.serverAddr, c.getNonce())
+		atomic.StoreInt64(&c.heartBeatSent, time.Now().UnixNano())
+		err := c.writeMsg(msgReq)
+		if err != nil {
+			log.Logger.Warn("HeartBeat with server:%s failed,err:%s", c.conn.RemoteAddr().String(), err.Error())
+			return false
+		}
+		select {
+		case <-stop:
+			// let msg being applied finish and answer,then stop reading
+			c.conn.SetReadDeadline(time.Now())
+			<-done
+			return true
+		case <-done:
+			return false
+		case <-time.After(time.Duration(config.GetClientConf().HeartBeatInterval) * time.Second):
+		}
+	}
+}
+
+func (c *pushConn) writeMsg(msg *syncproto.FileSyncProto) error {
+	msgData, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return common.WriteMsg(msgData, c.conn)
+}
+
+// readMsgs read heartbeat responses and pushed msgs until conn fails,
+// every pushed msg is applied and answered in order with its seq
+func (c *pushConn) readMsgs() {
+	serverAddr := c.conn.RemoteAddr().String()
+	serverIp := strings.Split(serverAddr, ":")[0]
+	for {
+		msgData, err := common.ReadMsg(c.conn)
+		if err != nil {
+			log.Logger.Warn("ReadMsg from conn:%s failed,err:%s", serverAddr, err.Error())
+			return
+		}
+		msg := &syncproto.FileSyncProto{}
+		err = proto.Unmarshal(msgData, msg)
+		if err != nil {
+			log.Logger.Warn("proto.Unmarshal failed,err:%s", err.Error())
+			return
+		}
+		syncproto.LogMsg(c.conn, msg)
+		if msg.GetMsgType() == syncproto.PROTO_MSG_HEART_BETA_RES {
+			sent := atomic.LoadInt64(&c.heartBeatSent)
+			heartBeatRttSeconds.WithLabelValues(serverIp).Observe(time.Since(time.Unix(0, sent)).Seconds())
+			c.nonce.Store(msg.GetNonce())
+			log.Logger.Debug("server:%s negotiated hash algo:%s", serverAddr, msg.GetHashAlgo())
+			continue
+		}
+		respMsg := applyServerMsg(serverIp, msg)
+		if respMsg == nil {
+			log.Logger.Warn("unsupport msgtype:%d from server:%s", msg.GetMsgType(), serverAddr)
+			respMsg = &syncproto.FileSyncProto{
+				Version:    proto.Uint32(syncproto.PROTO_VERSION),
+				MsgType:    proto.Uint32(syncproto.PROTO_MSG_COMMON_RESP_FAIL),
+				ContentLen: proto.Uint32(0),
+			}
+		}
+		// server matches response with msg by seq
+		respMsg.Seq = msg.Seq
+		err = c.writeMsg(respMsg)
+		if err != nil {
+			log.Logger.Warn("WriteMsg failed,err:%s", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package handle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+const (
+	SNAPSHOT_TIME_FORMAT = "20060102150405"
+	// snapshot is taken in tmp dir then renamed
+	SNAPSHOT_TMP_PREFIX = ".tmp-"
+	// separate sequence of snapshots taken in the same second,eg. 20171010120000-1
+	SNAPSHOT_SEQ_SEP = "-"
+)
+
+var (
+	snapshotLock = sync.Mutex{}
+)
+
+// getSnapshotSyncDir return sync dir of local dir which snapshot_dir is set
+func getSnapshotSyncDir(localDir string) (*config.FileSyncConf, error) {
+	dir, err := FindLocalSyncDir(localDir)
+	if err != nil {
+		return nil, err
+	}
+	if dir.SnapshotDir == "" {
+		return nil, fmt.Errorf("snapshot_dir of local_dir:%s is not set", dir.LocalDirName)
+	}
+	return dir, nil
+}
+
+// newSnapshotName return name of new snapshot,it is time with a sequence suffix
+// if another snapshot is taken in the same second
+func newSnapshotName(dir *config.FileSyncConf) string {
+	base := time.Now().Format(SNAPSHOT_TIME_FORMAT)
+	name := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(dir.SnapshotDir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s%s%d", base, SNAPSHOT_SEQ_SEP, i)
+	}
+}
+
+// parseSnapshotName return time and sequence of snapshot name
+func parseSnapshotName(name string) (time.Time, int, error) {
+	parts := strings.SplitN(name, SNAPSHOT_SEQ_SEP, 2)
+	t, err := time.ParseInLocation(SNAPSHOT_TIME_FORMAT, parts[0], time.Local)
+	if err != nil || len(parts) == 1 {
+		return t, 0, err
+	}
+	seq, err := strconv.Atoi(parts[1])
+	return t, seq, err
+}
+
+// isUnchanged return true if file info of snapshot copy is the same as local file
+func isUnchanged(snapshotInfo, info os.FileInfo) bool {
+	return snapshotInfo.Mode() == info.Mode() && snapshotInfo.Size() == info.Size() && snapshotInfo.ModTime().Equal(info.ModTime())
+}
+
+// copySnapshotFile copy file with its mode and modify time,which find unchanged files later
+func copySnapshotFile(srcFile, dstFile string, info os.FileInfo) error {
+	err := copyFile(srcFile, dstFile)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dstFile, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dstFile, info.ModTime(), info.ModTime())
+}
+
+// TakeSnapshot copy all files of local_dir into a new dir of snapshot_dir.
+// files unchanged since previous snapshot are hardlinked to it,so snapshots share
+// disk space with each other but never inodes of local_dir which may be changed in place
+func TakeSnapshot(dir *config.FileSyncConf) (string, error) {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	prevDir := ""
+	if snapshots, err := getSnapshots(dir); err == nil && len(snapshots) > 0 {
+		prevDir = filepath.Join(dir.SnapshotDir, snapshots[0])
+	}
+	name := newSnapshotName(dir)
+	tmpDir := filepath.Join(dir.SnapshotDir, SNAPSHOT_TMP_PREFIX+name)
+	os.RemoveAll(tmpDir)
+	log.Logger.Info("take snapshot:%s of local_dir:%s", name, dir.LocalDirName)
+	err := filepath.Walk(dir.LocalDirName, func(path string, info os.FileInfo, err error) error {
+		// file removed while snapshot is taken is not in it
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir.LocalDirName, path)
+		if err != nil {
+			return err
+		}
+		destFile := filepath.Join(tmpDir, relPath)
+		if info.IsDir() {
+			if dir.IsInternalPath(path) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(destFile, os.ModePerm)
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), TMP_FILE_PREFIX) || dir.IsInternalPath(path) {
+			return nil
+		}
+		if prevDir != "" {
+			prevFile := filepath.Join(prevDir, relPath)
+			if prevInfo, err := os.Lstat(prevFile); err == nil && isUnchanged(prevInfo, info) && os.Link(prevFile, destFile) == nil {
+				return nil
+			}
+		}
+		err = copySnapshotFile(path, destFile, info)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	err = os.Rename(tmpDir, filepath.Join(dir.SnapshotDir, name))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	pruneSnapshots(dir)
+	return name, nil
+}
+
+// getSnapshots return snapshots of sync dir,newest first
+func getSnapshots(dir *config.FileSyncConf) ([]string, error) {
+	files, err := ioutil.ReadDir(dir.SnapshotDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	snapshots := make([]string, 0)
+	times := make(map[string]time.Time)
+	seqs := make(map[string]int)
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		t, seq, err := parseSnapshotName(fi.Name())
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, fi.Name())
+		times[fi.Name()] = t
+		seqs[fi.Name()] = seq
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		ti, tj := times[snapshots[i]], times[snapshots[j]]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return seqs[snapshots[i]] > seqs[snapshots[j]]
+	})
+	return snapshots, nil
+}
+
+// pruneSnapshots remove snapshots more than snapshot_keep
+func pruneSnapshots(dir *config.FileSyncConf) {
+	if dir.SnapshotKeep <= 0 {
+		return
+	}
+	snapshots, err := getSnapshots(dir)
+	if err != nil {
+		log.Logger.Warn("get snapshots of local_dir:%s failed,err:%s", dir.LocalDirName, err.Error())
+		return
+	}
+	for i := dir.SnapshotKeep; i < len(snapshots); i++ {
+		log.Logger.Info("remove snapshot:%s of local_dir:%s", snapshots[i], dir.LocalDirName)
+		os.RemoveAll(filepath.Join(dir.SnapshotDir, snapshots[i]))
+	}
+}
+
+// processSnapshotMsg take snapshot of sync dir when server ask
+func processSnapshotMsg(serverIp string, msg *syncproto.FileSyncProto) error {
+	dir, err := getSyncDir(serverIp, msg.GetRootName())
+	if err != nil {
+		return err
+	}
+	if dir.SnapshotDir == "" {
+		return fmt.Errorf("snapshot_dir of local_dir:%s is not set", dir.LocalDirName)
+	}
+	if common.DryRun {
+		log.Logger.Info("dry-run: would take snapshot of local_dir:%s", dir.LocalDirName)
+		common.DryRunRecord(syncproto.GetMsgName(msg.GetMsgType()), 0)
+		return nil
+	}
+	_, err = TakeSnapshot(dir)
+	return err
+}
+
+// StartSnapshots take snapshot of sync dirs every snapshot_interval seconds.
+// it is called again when reload
+func StartSnapshots() {
+	runs := make(map[string]func(stop chan bool))
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if dir.SnapshotDir == "" || dir.SnapshotInterval <= 0 {
+			continue
+		}
+		dir := dir
+		runs[getDirKey(dir)] = func(stop chan bool) {
+			for !waitStop(stop, time.Duration(dir.SnapshotInterval)*time.Second) {
+				_, err := TakeSnapshot(dir)
+				if err != nil {
+					log.Logger.Error("take snapshot of local_dir:%s failed,err:%s", dir.LocalDirName, err.Error())
+				}
+			}
+		}
+	}
+	snapshotRunners.update(runs)
+}
+
+// ListSnapshots return snapshots of local dir,newest first
+func ListSnapshots(localDir string) ([]string, error) {
+	dir, err := getSnapshotSyncDir(localDir)
+	if err != nil {
+		return nil, err
+	}
+	return getSnapshots(dir)
+}
+
+// TakeLocalSnapshot take snapshot of local dir now
+func TakeLocalSnapshot(localDir string) (string, error) {
+	dir, err := getSnapshotSyncDir(localDir)
+	if err != nil {
+		return "", err
+	}
+	return TakeSnapshot(dir)
+}
+
+// RestoreSnapshot make local dir the same as snapshot,files not in snapshot are removed
+func RestoreSnapshot(localDir, snapshot string) error {
+	dir, err := getSnapshotSyncDir(localDir)
+	if err != nil {
+		return err
+	}
+	snapshotDir := filepath.Join(dir.SnapshotDir, snapshot)
+	_, err = os.Stat(snapshotDir)
+	if err != nil {
+		return err
+	}
+	// remove files not in snapshot
+	err = filepath.Walk(dir.LocalDirName, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir.LocalDirName {
+			return err
+		}
+		// snapshots,versions and quarantined files are kept
+		if dir.IsInternalPath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(dir.LocalDirName, path)
+		if err != nil {
+			return err
+		}
+		snapshotInfo, err := os.Lstat(filepath.Join(snapshotDir, relPath))
+		if err == nil && snapshotInfo.IsDir() == info.IsDir() {
+			return nil
+		}
+		log.Logger.Info("restore snapshot:%s,remove:%s", snapshot, path)
+		// restore is not drift
+		markApplied(path)
+		defer markApplied(path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// copy files changed after snapshot
+	return filepath.Walk(snapshotDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(snapshotDir, path)
+		if err != nil {
+			return err
+		}
+		destFile := filepath.Join(dir.LocalDirName, relPath)
+		if info.IsDir() {
+			if _, err := os.Stat(destFile); err == nil {
+				return nil
+			}
+			markApplied(destFile)
+			return os.MkdirAll(destFile, os.ModePerm)
+		}
+		destInfo, err := os.Lstat(destFile)
+		if err == nil && isUnchanged(info, destInfo) {
+			return nil
+		}
+		log.Logger.Info("restore snapshot:%s,copy:%s", snapshot, destFile)
+		markApplied(destFile)
+		defer markApplied(destFile)
+		tmpFile := filepath.Join(filepath.Dir(destFile), TMP_FILE_PREFIX+filepath.Base(destFile)+"."+snapshot)
+		err = copySnapshotFile(path, tmpFile, info)
+		if err != nil {
+			os.Remove(tmpFile)
+			return err
+		}
+		return os.Rename(tmpFile, destFile)
+	})
+}
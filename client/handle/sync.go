@@ -0,0 +1,228 @@
+package handle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+// SyncResult is summary of one shot sync
+type SyncResult struct {
+	Created   int
+	Written   int
+	Unchanged int
+	Failed    int
+	Bytes     int64
+}
+
+func (r *SyncResult) String() string {
+	return fmt.Sprintf("created:%d,written:%d,unchanged:%d,failed:%d,bytes:%d", r.Created, r.Written, r.Unchanged, r.Failed, r.Bytes)
+}
+
+// FindLocalSyncDir return sync dir which local_dir is localDir
+func FindLocalSyncDir(localDir string) (*config.FileSyncConf, error) {
+	absDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range config.GetClientConf().SyncDirs {
+		tmpDir, err := filepath.Abs(dir.LocalDirName)
+		if err == nil && tmpDir == absDir {
+			return dir, nil
+		}
+	}
+	return nil, fmt.Errorf("local dir:%s is not in config", localDir)
+}
+
+// isSameFile return true if local file has the same length and hash
+func isSameFile(filename, hashAlgo, fileHash string, fileLen int64) bool {
+	tmpLen, tmpHash, err := common.GHashCache.GetFileHash(hashAlgo, filename)
+	return err == nil && int64(tmpLen) == fileLen && tmpHash == fileHash
+}
+
+// syncLocalDir create dir if it not exist
+func syncLocalDir(destFile string, result *SyncResult) {
+	fi, err := os.Stat(destFile)
+	if err == nil && fi.IsDir() {
+		result.Unchanged++
+		return
+	}
+	err = applyFileMsg(destFile, &syncproto.FileSyncProto{
+		MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_CREATE_REQ),
+		ContentLen: proto.Uint32(syncproto.PROTO_DIR_LEN),
+	})
+	if err != nil {
+		log.Logger.Warn("sync create dir:%s failed,err:%s", destFile, err.Error())
+		result.Failed++
+		return
+	}
+	result.Created++
+}
+
+// listServer return all files of sync dir on server and hash algo of them,
+// they are listed by pages
+func listServer(dir *config.FileSyncConf) ([]*syncproto.ListEntry, string, error) {
+	entries := make([]*syncproto.ListEntry, 0)
+	hashAlgo := ""
+	cursor := ""
+	for {
+		msg := &syncproto.FileSyncProto{
+			MsgType:  proto.Uint32(syncproto.PROTO_MSG_FILE_LIST_REQ),
+			HashAlgo: proto.String(getHashAlgos()),
+			RelPath:  proto.String(cursor),
+		}
+		respMsg, err := requestServer(dir, msg)
+		if err != nil {
+			return nil, "", err
+		}
+		page := make([]*syncproto.ListEntry, 0)
+		err = json.Unmarshal(respMsg.GetContent(), &page)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, page...)
+		hashAlgo = respMsg.GetHashAlgo()
+		// old server list all files at once
+		if respMsg.GetRelPath() == "" || respMsg.GetRelPath() == cursor {
+			return entries, hashAlgo, nil
+		}
+		cursor = respMsg.GetRelPath()
+	}
+}
+
+// SyncFromServer bring local_dir of sync dir up to date with its server once,
+// like the initial sync of server: missing dirs are created, missing or
+// changed files are fetched and local files not on server are kept
+func SyncFromServer(dir *config.FileSyncConf) (*SyncResult, error) {
+	entries, hashAlgo, err := listServer(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncResult{}
+	for _, entry := range entries {
+		destFile, err := resolveRelPath(dir, entry.Path)
+		if err != nil {
+			log.Logger.Warn("sync file:%s of root:%s failed,err:%s", entry.Path, dir.GetRoot(), err.Error())
+			result.Failed++
+			continue
+		}
+		if entry.Dir {
+			syncLocalDir(destFile, result)
+			continue
+		}
+		if isSameFile(destFile, hashAlgo, entry.Hash, entry.Len) {
+			result.Unchanged++
+			continue
+		}
+		err = fetchFile(dir, destFile, entry.Path, result)
+		if err != nil {
+			log.Logger.Warn("sync file:%s of root:%s failed,err:%s", entry.Path, dir.GetRoot(), err.Error())
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+func fetchFile(dir *config.FileSyncConf, destFile, relPath string, result *SyncResult) error {
+	msg := &syncproto.FileSyncProto{
+		MsgType: proto.Uint32(syncproto.PROTO_MSG_FILE_FETCH_REQ),
+		RelPath: proto.String(relPath),
+	}
+	respMsg, err := requestServer(dir, msg)
+	if err != nil {
+		return err
+	}
+	if respMsg.GetRootName() != dir.GetRoot() || respMsg.GetRelPath() != relPath {
+		return fmt.Errorf("server response root:%s,path:%s,not equal request", respMsg.GetRootName(), respMsg.GetRelPath())
+	}
+	err = applyFileMsg(destFile, respMsg)
+	if err != nil {
+		return err
+	}
+	result.Written++
+	result.Bytes += int64(len(respMsg.GetContent()))
+	return nil
+}
+
+// SyncFromDir bring local_dir of sync dir up to date with local source dir once
+func SyncFromDir(srcDir string, dir *config.FileSyncConf) (*SyncResult, error) {
+	hashAlgo := config.GetClientConf().HashAlgo
+	if hashAlgo == "" {
+		hashAlgo = common.SupportHashAlgos[0]
+	}
+	result := &SyncResult{}
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == srcDir {
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		destFile, err := resolveRelPath(dir, filepath.ToSlash(relPath))
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			syncLocalDir(destFile, result)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		err = copySrcFile(path, destFile, hashAlgo, result)
+		if err != nil {
+			log.Logger.Warn("sync file:%s to %s failed,err:%s", path, destFile, err.Error())
+			result.Failed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func copySrcFile(srcFile, destFile, hashAlgo string, result *SyncResult) error {
+	fileLen, fileHash, err := common.GHashCache.GetFileHash(hashAlgo, srcFile)
+	if err != nil {
+		return err
+	}
+	if isSameFile(destFile, hashAlgo, fileHash, int64(fileLen)) {
+		result.Unchanged++
+		return nil
+	}
+	data, err := ioutil.ReadFile(srcFile)
+	if err != nil {
+		return err
+	}
+	// file may be changed after hashing
+	fileHash, err = common.GetDataHash(hashAlgo, data)
+	if err != nil {
+		return err
+	}
+	err = applyFileMsg(destFile, &syncproto.FileSyncProto{
+		MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+		ContentLen: proto.Uint32(uint32(len(data))),
+		Content:    data,
+		HashAlgo:   proto.String(hashAlgo),
+		FileHash:   proto.String(fileHash),
+	})
+	if err != nil {
+		return err
+	}
+	result.Written++
+	result.Bytes += int64(len(data))
+	return nil
+}
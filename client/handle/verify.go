@@ -0,0 +1,108 @@
+package handle
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wlibo666/filesync/client/config"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+// VerifyResult is difference between local_dir and its root on server,
+// paths are slash separated and relative to local_dir
+type VerifyResult struct {
+	LocalDir string   `json:"local_dir"`
+	Root     string   `json:"root"`
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+	Differ   []string `json:"differ"`
+}
+
+func (r *VerifyResult) IsSame() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Differ) == 0
+}
+
+// isInternalDir return true if path is quarantine, versions or snapshot dir of sync dir
+func isInternalDir(dir *config.FileSyncConf, path string) bool {
+	for _, internalDir := range []string{dir.QuarantineDir, dir.VersionsDir, dir.SnapshotDir} {
+		if internalDir != "" && filepath.Clean(internalDir) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyDir compare local_dir of sync dir with its root on server,nothing is changed
+func VerifyDir(dir *config.FileSyncConf) (*VerifyResult, error) {
+	entries, hashAlgo, err := listServer(dir)
+	if err != nil {
+		return nil, err
+	}
+	return diffLocalDir(dir, entries, hashAlgo)
+}
+
+// diffLocalDir compare local_dir of sync dir with files listed by server
+func diffLocalDir(dir *config.FileSyncConf, entries []*syncproto.ListEntry, hashAlgo string) (*VerifyResult, error) {
+	result := &VerifyResult{
+		LocalDir: dir.LocalDirName,
+		Root:     dir.GetRoot(),
+		Missing:  make([]string, 0),
+		Extra:    make([]string, 0),
+		Differ:   make([]string, 0),
+	}
+	serverFiles := make(map[string]*syncproto.ListEntry)
+	for _, entry := range entries {
+		serverFiles[entry.Path] = entry
+		destFile, err := resolveRelPath(dir, entry.Path)
+		if err != nil {
+			result.Differ = append(result.Differ, entry.Path)
+			continue
+		}
+		fi, err := os.Lstat(destFile)
+		if err != nil {
+			result.Missing = append(result.Missing, entry.Path)
+			continue
+		}
+		if fi.IsDir() != entry.Dir || (!entry.Dir && !isSameFile(destFile, hashAlgo, entry.Hash, entry.Len)) {
+			result.Differ = append(result.Differ, entry.Path)
+		}
+	}
+	localDir := filepath.Clean(dir.LocalDirName)
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == localDir {
+			return nil
+		}
+		if info.IsDir() && isInternalDir(dir, path) {
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), TMP_FILE_PREFIX) {
+			return nil
+		}
+		relPath, err := filepath.Rel(localDir, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if _, ok := serverFiles[relPath]; ok {
+			return nil
+		}
+		result.Extra = append(result.Extra, relPath)
+		// files in extra dir are not reported one by one
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Extra)
+	sort.Strings(result.Differ)
+	return result, nil
+}
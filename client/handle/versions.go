@@ -0,0 +1,236 @@
+package handle
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/client/config"
+)
+
+const (
+	// version file is named as file~time
+	VERSION_SEP         = "~"
+	VERSION_TIME_FORMAT = "20060102150405.000000"
+
+	VERSIONS_PRUNE_INTERVAL = 3600
+)
+
+// getLocalSyncDir return sync dir which local file is under and the slash
+// separated path relative to its local_dir,the longest local_dir wins
+func getLocalSyncDir(filename string) (*config.FileSyncConf, string, error) {
+	var syncDir *config.FileSyncConf
+	relPath := ""
+	for _, dir := range config.GetClientConf().SyncDirs {
+		tmpPath, err := filepath.Rel(dir.LocalDirName, filename)
+		if err != nil || tmpPath == "." || tmpPath == ".." || strings.HasPrefix(tmpPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if syncDir == nil || len(dir.LocalDirName) > len(syncDir.LocalDirName) {
+			syncDir = dir
+			relPath = filepath.ToSlash(tmpPath)
+		}
+	}
+	if syncDir == nil {
+		return nil, "", fmt.Errorf("file:%s is not in any local dir", filename)
+	}
+	return syncDir, relPath, nil
+}
+
+func copyFile(srcFile, dstFile string) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// backupFile keep a version of file before it is overwritten or removed,
+// file is moved to versions dir if move,otherwise hardlinked or copied.
+// all files in it are kept if file is a dir.
+func backupFile(filename string, move bool) error {
+	dir, relPath, err := getLocalSyncDir(filename)
+	if err != nil || dir.VersionsDir == "" {
+		return nil
+	}
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return filepath.Walk(filename, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			return backupFile(path, move)
+		})
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	versionFile := filepath.Join(dir.VersionsDir, filepath.FromSlash(relPath)) + VERSION_SEP + time.Now().Format(VERSION_TIME_FORMAT)
+	os.MkdirAll(filepath.Dir(versionFile), os.ModePerm)
+	log.Logger.Info("keep version of file:%s as %s", filename, versionFile)
+	if move {
+		err = os.Rename(filename, versionFile)
+	} else {
+		err = os.Link(filename, versionFile)
+	}
+	if err != nil {
+		err = copyFile(filename, versionFile)
+		if err != nil {
+			return err
+		}
+	}
+	return pruneFileVersions(dir, versionFile[:strings.LastIndex(versionFile, VERSION_SEP)])
+}
+
+// getVersions return versions of file in versions dir,newest first
+func getVersions(versionBase string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Dir(versionBase))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := filepath.Base(versionBase) + VERSION_SEP
+	versions := make([]string, 0)
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		version := strings.TrimPrefix(fi.Name(), prefix)
+		_, err := time.ParseInLocation(VERSION_TIME_FORMAT, version, time.Local)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// pruneFileVersions remove versions more than versions_keep or older than versions_max_days
+func pruneFileVersions(dir *config.FileSyncConf, versionBase string) error {
+	versions, err := getVersions(versionBase)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, version := range versions {
+		t, _ := time.ParseInLocation(VERSION_TIME_FORMAT, version, time.Local)
+		if (dir.VersionsKeep > 0 && i >= dir.VersionsKeep) ||
+			(dir.VersionsMaxDays > 0 && now.Sub(t) > time.Duration(dir.VersionsMaxDays)*24*time.Hour) {
+			versionFile := versionBase + VERSION_SEP + version
+			log.Logger.Info("remove version:%s", versionFile)
+			os.Remove(versionFile)
+		}
+	}
+	return nil
+}
+
+// PruneVersions remove expired versions of all sync dirs
+func PruneVersions() {
+	for _, dir := range config.GetClientConf().SyncDirs {
+		if dir.VersionsDir == "" {
+			continue
+		}
+		pruned := make(map[string]bool)
+		filepath.Walk(dir.VersionsDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			idx := strings.LastIndex(path, VERSION_SEP)
+			if idx < 0 || pruned[path[:idx]] {
+				return nil
+			}
+			pruned[path[:idx]] = true
+			return pruneFileVersions(dir, path[:idx])
+		})
+	}
+}
+
+// StartPruneVersions remove expired versions periodically
+func StartPruneVersions() {
+	go func() {
+		for {
+			PruneVersions()
+			time.Sleep(VERSIONS_PRUNE_INTERVAL * time.Second)
+		}
+	}()
+}
+
+func getVersionBase(filename string) (string, error) {
+	absFile, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	dir, relPath, err := getLocalSyncDir(absFile)
+	if err != nil {
+		return "", err
+	}
+	if dir.VersionsDir == "" {
+		return "", fmt.Errorf("versions_dir of local_dir:%s is not set", dir.LocalDirName)
+	}
+	return filepath.Join(dir.VersionsDir, filepath.FromSlash(relPath)), nil
+}
+
+// ListVersions return versions of local file,newest first
+func ListVersions(filename string) ([]string, error) {
+	versionBase, err := getVersionBase(filename)
+	if err != nil {
+		return nil, err
+	}
+	return getVersions(versionBase)
+}
+
+// RestoreVersion restore local file to version,current file is kept as a version
+func RestoreVersion(filename, version string) error {
+	versionBase, err := getVersionBase(filename)
+	if err != nil {
+		return err
+	}
+	versionFile := versionBase + VERSION_SEP + version
+	_, err = os.Stat(versionFile)
+	if err != nil {
+		return err
+	}
+	absFile, _ := filepath.Abs(filename)
+	// restore is not drift
+	markApplied(absFile)
+	defer markApplied(absFile)
+	os.MkdirAll(filepath.Dir(absFile), os.ModePerm)
+	// copy version first,it may be pruned when current file is kept
+	tmpFile := filepath.Join(filepath.Dir(absFile), TMP_FILE_PREFIX+filepath.Base(absFile)+"."+version)
+	err = copyFile(versionFile, tmpFile)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	err = backupFile(absFile, false)
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, absFile)
+}
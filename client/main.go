@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/wlibo666/common-lib/log"
 	"github.com/wlibo666/filesync/client/config"
@@ -13,38 +15,121 @@ import (
 )
 
 var (
-	ConfFile = flag.String("conf", "./conf/client.json", "config file,eg: -conf ./conf/client.json")
+	DryRun      = flag.Bool("dry-run", false, "only log what would be done,eg: -dry-run")
+	CheckConfig = flag.Bool("check-config", false, "check config file then exit,eg: -check-config")
+	ConfFile    = flag.String("conf", "./conf/client.json", "config file,eg: -conf ./conf/client.json")
 )
 
 func RegistryCtlCSignal() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func(c chan os.Signal) {
 		sig := <-c
 		log.Logger.Info("recv signal:%s then exit", sig.String())
-		os.Exit(2)
+		drained := handle.Shutdown(time.Duration(config.GetClientConf().ShutdownTimeout) * time.Second)
+		common.GHashCache.Save()
+		if common.DryRun {
+			log.Logger.Info("%s", common.DryRunSummary())
+			fmt.Fprintf(os.Stdout, "%s\n", common.DryRunSummary())
+		}
+		if !drained {
+			os.Exit(2)
+		}
+		os.Exit(0)
 	}(c)
 }
 
+// RegistryReloadSignal reload config on SIGHUP
+func RegistryReloadSignal() {
+	c := make(chan os.Signal, 1)
+	common.NotifyReload(c)
+	go func(c chan os.Signal) {
+		for sig := range c {
+			log.Logger.Info("recv signal:%s then reload config", sig.String())
+			handle.Reload()
+		}
+	}(c)
+}
+
+// RunCheckConfig print problems of config file,return exit code
+func RunCheckConfig() int {
+	errs := config.CheckConfig(*ConfFile)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "config [%s] has %d problems\n", *ConfFile, len(errs))
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "config [%s] is ok\n", *ConfFile)
+	return 0
+}
+
 func main() {
 	flag.Parse()
+	if *CheckConfig {
+		os.Exit(RunCheckConfig())
+	}
 	Prepare()
+	if flag.NArg() > 0 {
+		os.Exit(RunCommand(flag.Args()))
+	}
 	RegistryCtlCSignal()
+	RegistryReloadSignal()
 	log.Logger.Info("program [%s] start...", os.Args[0])
 
+	// dry run change nothing on disk
+	if !common.DryRun {
+		handle.CleanTempFiles()
+	}
 	handle.StartHeartBeat()
-	common.StartListen(config.GClientConf.ListenAddr, handle.ProcessServer)
+	if config.GetClientConf().MetricsListen != "" {
+		common.StartMetricsListener(config.GetClientConf().MetricsListen)
+	}
+	handle.StartDriftWatch()
+	if !common.DryRun {
+		handle.StartPruneVersions()
+		handle.StartSnapshots()
+	}
+	// single port client receive msgs on its heartbeat conns
+	if !config.GetClientConf().SinglePort {
+		common.StartListen(config.GetClientConf().ListenAddr, handle.ProcessServer)
+	}
+	// listener is closed by shutdown,wait it to exit
+	select {}
 }
 
 func Prepare() error {
+	common.DryRun = *DryRun
 	err := config.LoadConfig(*ConfFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "LoadConfig [%s] failed,err:%s\n", *ConfFile, err.Error())
 		os.Exit(1)
 	}
-	log.SetFileLogger(config.GClientConf.LogFile, config.GClientConf.LogFileNum)
-	if config.GClientConf.DebugFlag {
+	log.SetFileLogger(config.GetClientConf().LogFile, config.GetClientConf().LogFileNum)
+	if config.GetClientConf().DebugFlag {
 		log.SetLoggerDebug()
 	}
+	if config.GetClientConf().JsonLog != "" {
+		common.GJsonLog, err = common.NewJsonLogger(config.GetClientConf().JsonLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open json log [%s] failed,err:%s\n", config.GetClientConf().JsonLog, err.Error())
+			os.Exit(1)
+		}
+	}
+	if config.GetClientConf().AuditLog != "" {
+		err = handle.OpenAuditLog(config.GetClientConf().AuditLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open audit log [%s] failed,err:%s\n", config.GetClientConf().AuditLog, err.Error())
+			os.Exit(1)
+		}
+	}
+	if config.GetClientConf().HashCache != "" {
+		err = common.LoadHashCache(config.GetClientConf().HashCache)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadHashCache [%s] failed,err:%s\n", config.GetClientConf().HashCache, err.Error())
+			os.Exit(1)
+		}
+	}
 	return nil
 }
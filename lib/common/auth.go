@@ -0,0 +1,33 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// NewNonce return random hex string,server sends one per heartbeat conn to client
+// so that tokens made for it are useless on other conns
+func NewNonce() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// NewClientToken return token proving client knows secret of its id,
+// it is hmac-sha256 of id and nonce of server conn,so secret is not sent
+func NewClientToken(secret, id, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s", id, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckClientToken return true if token is made by secret of id for nonce
+func CheckClientToken(secret, id, nonce, token string) bool {
+	if secret == "" || nonce == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(NewClientToken(secret, id, nonce)))
+}
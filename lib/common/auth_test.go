@@ -0,0 +1,34 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestClientToken(t *testing.T) {
+	nonce := NewNonce()
+	if len(nonce) != 32 || nonce == NewNonce() {
+		t.Fatalf("nonce:%s is not random", nonce)
+	}
+	token := NewClientToken("secret", "web-01", nonce)
+	cases := []struct {
+		secret string
+		id     string
+		nonce  string
+		token  string
+		ok     bool
+	}{
+		{"secret", "web-01", nonce, token, true},
+		{"secret", "web-01", NewNonce(), token, false},
+		{"secret", "web-01", "", NewClientToken("secret", "web-01", ""), false},
+		{"other", "web-01", nonce, token, false},
+		{"secret", "web-02", nonce, token, false},
+		{"", "web-01", nonce, NewClientToken("", "web-01", nonce), false},
+		{"secret", "web-01", nonce, "", false},
+		{"secret", "web-01", nonce, "abc", false},
+	}
+	for _, c := range cases {
+		if CheckClientToken(c.secret, c.id, c.nonce, c.token) != c.ok {
+			t.Fatalf("CheckClientToken(%s,%s,%s,%s) should be %v", c.secret, c.id, c.nonce, c.token, c.ok)
+		}
+	}
+}
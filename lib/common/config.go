@@ -2,17 +2,191 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 )
 
-func LoadConf(filename string, conf interface{}) error {
+const (
+	// top level option can be overridden by env,eg. FILESYNC_LOG_FILE for log_file
+	CONF_ENV_PREFIX = "FILESYNC_"
+)
+
+// readConf read json, yaml or toml config file by its extension,
+// return it decoded as json,eg. map[string]interface{}
+func readConf(filename string) (interface{}, error) {
 	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+		raw = yamlToJson(raw)
+	case ".toml":
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(data), &m)
+		raw = m
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// decode again as json,so values of all formats have the same types
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	raw = nil
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := raw.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("config file:%s is not an object", filename)
+	}
+	return raw, nil
+}
+
+// yamlToJson convert map[interface{}]interface{} decoded by yaml to map[string]interface{}
+func yamlToJson(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			m[fmt.Sprintf("%v", key)] = yamlToJson(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range value {
+			value[i] = yamlToJson(item)
+		}
+	}
+	return v
+}
+
+// getConfField return field of struct t whose json name is key,json names are case insensitive
+func getConfField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// applyConfEnv override top level string,bool and int options with env
+func applyConfEnv(raw map[string]interface{}, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := CONF_ENV_PREFIX + strings.ToUpper(name)
+		env, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			raw[name] = env
+		case reflect.Bool:
+			value, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("invalid bool env %s:%s", envName, env)
+			}
+			raw[name] = value
+		case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32, reflect.Uint64:
+			value, err := strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid int env %s:%s", envName, env)
+			}
+			raw[name] = value
+		}
+	}
+	return nil
+}
+
+// LoadConf load json, yaml(.yaml/.yml) or toml(.toml) config file into conf,
+// top level options are overridden by env FILESYNC_<OPTION>,unknown keys are ignored
+func LoadConf(filename string, conf interface{}) error {
+	raw, err := readConf(filename)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(data, conf)
+	t := reflect.TypeOf(conf).Elem()
+	if t.Kind() == reflect.Struct {
+		err = applyConfEnv(raw.(map[string]interface{}), t)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(raw)
 	if err != nil {
 		return err
 	}
-	return nil
+	return json.Unmarshal(data, conf)
+}
+
+// unknownConfKeys return keys of v which are not options of t,eg. moni_dir[0].dirr
+func unknownConfKeys(prefix string, v interface{}, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	keys := make([]string, 0)
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return keys
+		}
+		for key, item := range m {
+			field, ok := getConfField(t, key)
+			if !ok {
+				keys = append(keys, prefix+key)
+				continue
+			}
+			keys = append(keys, unknownConfKeys(prefix+key+".", item, field.Type)...)
+		}
+	case reflect.Slice:
+		items, ok := v.([]interface{})
+		if !ok {
+			return keys
+		}
+		prefix = strings.TrimSuffix(prefix, ".")
+		for i, item := range items {
+			keys = append(keys, unknownConfKeys(fmt.Sprintf("%s[%d].", prefix, i), item, t.Elem())...)
+		}
+	}
+	return keys
+}
+
+// CheckConfKeys return keys in config file which are not options of conf,sorted
+func CheckConfKeys(filename string, conf interface{}) ([]string, error) {
+	raw, err := readConf(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys := unknownConfKeys("", raw, reflect.TypeOf(conf))
+	sort.Strings(keys)
+	return keys, nil
 }
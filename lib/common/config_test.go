@@ -0,0 +1,88 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testConfDir struct {
+	Dir       string   `json:"dir"`
+	WhiteList []string `json:"white_list"`
+}
+
+type testConf struct {
+	ListenAddr string         `json:"listen"`
+	DebugFlag  bool           `json:"debug"`
+	LogFileNum int            `json:"log_file_num"`
+	Dirs       []*testConfDir `json:"moni_dir"`
+}
+
+func TestLoadConf(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	files := map[string]string{
+		"conf.json": `{"listen":":6000","debug":true,"log_file_num":3,"moni_dir":[{"dir":"/data","white_list":["10.0.0.1:6000"]}]}`,
+		"conf.yaml": "listen: \":6000\"\ndebug: true\nlog_file_num: 3\nmoni_dir:\n  - dir: /data\n    white_list: [\"10.0.0.1:6000\"]\n",
+		"conf.toml": "listen = \":6000\"\ndebug = true\nlog_file_num = 3\n[[moni_dir]]\ndir = \"/data\"\nwhite_list = [\"10.0.0.1:6000\"]\n",
+	}
+	expect := &testConf{
+		ListenAddr: ":6000",
+		DebugFlag:  true,
+		LogFileNum: 3,
+		Dirs:       []*testConfDir{{Dir: "/data", WhiteList: []string{"10.0.0.1:6000"}}},
+	}
+	for name, content := range files {
+		filename := filepath.Join(tmpDir, name)
+		ioutil.WriteFile(filename, []byte(content), 0644)
+		conf := &testConf{}
+		err = LoadConf(filename, conf)
+		if err != nil {
+			t.Fatalf("LoadConf %s failed,err:%s", name, err.Error())
+		}
+		if !reflect.DeepEqual(conf, expect) {
+			t.Fatalf("LoadConf %s got:%+v", name, conf)
+		}
+	}
+
+	os.Setenv("FILESYNC_LISTEN", ":7000")
+	os.Setenv("FILESYNC_LOG_FILE_NUM", "5")
+	defer os.Unsetenv("FILESYNC_LISTEN")
+	defer os.Unsetenv("FILESYNC_LOG_FILE_NUM")
+	conf := &testConf{}
+	err = LoadConf(filepath.Join(tmpDir, "conf.yaml"), conf)
+	if err != nil {
+		t.Fatalf("LoadConf failed,err:%s", err.Error())
+	}
+	if conf.ListenAddr != ":7000" || conf.LogFileNum != 5 || !conf.DebugFlag {
+		t.Fatalf("env not applied,got:%+v", conf)
+	}
+	os.Setenv("FILESYNC_LOG_FILE_NUM", "five")
+	err = LoadConf(filepath.Join(tmpDir, "conf.yaml"), conf)
+	if err == nil {
+		t.Fatalf("LoadConf should fail with invalid env")
+	}
+}
+
+func TestCheckConfKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "conf.json")
+	ioutil.WriteFile(filename, []byte(`{"listen":":6000","Debug":true,"log_fle":"a.log","moni_dir":[{"dir":"/data"},{"dirr":"/data2"}]}`), 0644)
+	keys, err := CheckConfKeys(filename, &testConf{})
+	if err != nil {
+		t.Fatalf("CheckConfKeys failed,err:%s", err.Error())
+	}
+	expect := []string{"log_fle", "moni_dir[1].dirr"}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("CheckConfKeys got:%v,expect:%v", keys, expect)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DryRunStats count ops which would be done in dry run
+type DryRunStats struct {
+	counts map[string]int
+	bytes  map[string]int64
+	lock   sync.Mutex
+}
+
+var (
+	// DryRun only log what would be done
+	DryRun = false
+
+	dryRunStats = NewDryRunStats()
+)
+
+func NewDryRunStats() *DryRunStats {
+	return &DryRunStats{
+		counts: make(map[string]int),
+		bytes:  make(map[string]int64),
+	}
+}
+
+// Record count op which would be done
+func (stats *DryRunStats) Record(op string, bytes int) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.counts[op]++
+	stats.bytes[op] += int64(bytes)
+}
+
+// Summary return ops which would be done,eg. writeReq:2(1024 bytes)
+func (stats *DryRunStats) Summary() string {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	ops := make([]string, 0, len(stats.counts))
+	for op := range stats.counts {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	summary := make([]string, 0, len(ops))
+	for _, op := range ops {
+		summary = append(summary, fmt.Sprintf("%s:%d(%d bytes)", op, stats.counts[op], stats.bytes[op]))
+	}
+	if len(summary) == 0 {
+		return "dry-run summary:nothing to do"
+	}
+	return "dry-run summary:" + strings.Join(summary, ",")
+}
+
+// DryRunRecord count op which would be done in dry run
+func DryRunRecord(op string, bytes int) {
+	dryRunStats.Record(op, bytes)
+}
+
+// DryRunSummary return all ops which would be done in dry run
+func DryRunSummary() string {
+	return dryRunStats.Summary()
+}
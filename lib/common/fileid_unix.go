@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// return device and inode of file
+func GetFileId(filename string, fi os.FileInfo) (uint64, uint64, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return uint64(0), uint64(0), fmt.Errorf("not found stat of file:%s", filename)
+	}
+	return uint64(st.Dev), uint64(st.Ino), nil
+}
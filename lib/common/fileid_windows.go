@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+// return volume serial number and file index of file
+func GetFileId(filename string, fi os.FileInfo) (uint64, uint64, error) {
+	namePtr, err := syscall.UTF16PtrFromString(filename)
+	if err != nil {
+		return uint64(0), uint64(0), err
+	}
+	h, err := syscall.CreateFile(namePtr, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return uint64(0), uint64(0), err
+	}
+	defer syscall.CloseHandle(h)
+	var info syscall.ByHandleFileInformation
+	err = syscall.GetFileInformationByHandle(h, &info)
+	if err != nil {
+		return uint64(0), uint64(0), err
+	}
+	return uint64(info.VolumeSerialNumber), uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
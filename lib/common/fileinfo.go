@@ -12,10 +12,14 @@ func GetFileInfo(filename string) (uint32, string, error) {
 	if err != nil {
 		return uint32(0), "", err
 	}
+	return uint32(len(data)), GetDataMd5(data), nil
+}
+
+func GetDataMd5(data []byte) string {
 	sum := md5.Sum(data)
-	fileMd5 := ""
+	dataMd5 := ""
 	for i := 0; i < md5.Size; i++ {
-		fileMd5 += fmt.Sprintf("%02x", sum[i])
+		dataMd5 += fmt.Sprintf("%02x", sum[i])
 	}
-	return uint32(len(data)), fileMd5, nil
+	return dataMd5
 }
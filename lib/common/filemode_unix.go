@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// read once when start,Umask is process wide and not safe to call later
+	fileUmask = readUmask()
+)
+
+func readUmask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}
+
+// GetNewFileMode return mode of file created by os.Create,0666 without umask
+func GetNewFileMode() os.FileMode {
+	return 0666 &^ fileUmask
+}
+
+// SyncDir fsync dir so that rename or create in it is durable
+func SyncDir(dirName string) error {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package common
+
+import (
+	"os"
+)
+
+// GetNewFileMode return mode of file created by os.Create
+func GetNewFileMode() os.FileMode {
+	return 0666
+}
+
+// SyncDir do nothing,dir can not be fsynced on windows
+func SyncDir(dirName string) error {
+	return nil
+}
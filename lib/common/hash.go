@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+)
+
+const (
+	HASH_ALGO_MD5    = "md5"
+	HASH_ALGO_SHA256 = "sha256"
+	HASH_ALGO_BLAKE3 = "blake3"
+	HASH_ALGO_XXHASH = "xxhash"
+)
+
+var (
+	// order is the preference when peers negotiate
+	SupportHashAlgos = []string{HASH_ALGO_BLAKE3, HASH_ALGO_XXHASH, HASH_ALGO_SHA256, HASH_ALGO_MD5}
+)
+
+func NewHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case HASH_ALGO_MD5, "":
+		return md5.New(), nil
+	case HASH_ALGO_SHA256:
+		return sha256.New(), nil
+	case HASH_ALGO_BLAKE3:
+		return blake3.New(), nil
+	case HASH_ALGO_XXHASH:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupport hash algo:%s", algo)
+	}
+}
+
+func IsSupportHashAlgo(algo string) bool {
+	for _, tmpAlgo := range SupportHashAlgos {
+		if tmpAlgo == algo {
+			return true
+		}
+	}
+	return false
+}
+
+func GetDataHash(algo string, data []byte) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// return fileLen,hash, error
+func GetFileHash(algo, filename string) (uint32, string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return uint32(0), "", err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return uint32(0), "", err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return uint32(0), "", err
+	}
+	return uint32(n), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NegotiateHashAlgo return algo if peer support it,otherwise md5 which every peer support,
+// md5 is also used if algo is empty
+func NegotiateHashAlgo(algo, peerAlgos string) string {
+	if !IsSupportHashAlgo(algo) {
+		return HASH_ALGO_MD5
+	}
+	for _, peerAlgo := range strings.Split(peerAlgos, ",") {
+		if peerAlgo == algo {
+			return algo
+		}
+	}
+	return HASH_ALGO_MD5
+}
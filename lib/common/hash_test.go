@@ -0,0 +1,48 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestGetFileHash(t *testing.T) {
+	fileName := "./hash.go"
+
+	_, md5, err := GetFileInfo(fileName)
+	if err != nil {
+		t.Fatalf("GetFileInfo failed,err:%s", err.Error())
+	}
+	for _, algo := range SupportHashAlgos {
+		fileLen, fileHash, err := GetFileHash(algo, fileName)
+		if err != nil {
+			t.Fatalf("GetFileHash by %s failed,err:%s", algo, err.Error())
+		}
+		t.Logf("filename:%s,len:%d,%s:%s", fileName, fileLen, algo, fileHash)
+		if algo == HASH_ALGO_MD5 && fileHash != md5 {
+			t.Fatalf("md5 not equal,GetFileInfo:%s,GetFileHash:%s", md5, fileHash)
+		}
+	}
+	_, _, err = GetFileHash("crc32", fileName)
+	if err == nil {
+		t.Fatalf("GetFileHash by unsupport algo should failed")
+	}
+}
+
+func TestNegotiateHashAlgo(t *testing.T) {
+	cases := []struct {
+		algo      string
+		peerAlgos string
+		want      string
+	}{
+		{HASH_ALGO_SHA256, "blake3,sha256,md5", HASH_ALGO_SHA256},
+		{HASH_ALGO_SHA256, "xxhash,md5", HASH_ALGO_MD5},
+		{HASH_ALGO_BLAKE3, "", HASH_ALGO_MD5},
+		{"", "crc32,sha256", HASH_ALGO_MD5},
+		{"crc32", "crc32,sha256", HASH_ALGO_MD5},
+	}
+	for _, c := range cases {
+		algo := NegotiateHashAlgo(c.algo, c.peerAlgos)
+		if algo != c.want {
+			t.Fatalf("NegotiateHashAlgo(%s,%s) is %s,want %s", c.algo, c.peerAlgos, algo, c.want)
+		}
+	}
+}
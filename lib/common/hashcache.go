@@ -0,0 +1,198 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+)
+
+const (
+	HASH_CACHE_SAVE_INTERVAL = 60
+)
+
+type HashCacheEntry struct {
+	Dev    uint64            `json:"dev"`
+	Ino    uint64            `json:"ino"`
+	Size   int64             `json:"size"`
+	MTime  int64             `json:"mtime"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+// HashCache remember file hash by (device, inode, size, mtime),
+// so that unchanged file is never read again
+type HashCache struct {
+	fileName string
+	dirty    bool
+	rwLock   sync.RWMutex
+	entries  map[string]*HashCacheEntry
+}
+
+var (
+	// memory only until LoadHashCache is called
+	GHashCache = NewHashCache("")
+)
+
+func NewHashCache(filename string) *HashCache {
+	return &HashCache{
+		fileName: filename,
+		entries:  make(map[string]*HashCacheEntry),
+	}
+}
+
+// LoadHashCache load GHashCache from filename and save it periodically
+func LoadHashCache(filename string) error {
+	GHashCache = NewHashCache(filename)
+	err := GHashCache.Load()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			time.Sleep(HASH_CACHE_SAVE_INTERVAL * time.Second)
+			err := GHashCache.Save()
+			if err != nil {
+				log.Logger.Warn("save hash cache:%s failed,err:%s", filename, err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *HashCache) Load() error {
+	if c.fileName == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := make(map[string]*HashCacheEntry)
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	c.rwLock.Lock()
+	c.entries = entries
+	c.rwLock.Unlock()
+	return nil
+}
+
+func (c *HashCache) Save() error {
+	if c.fileName == "" {
+		return nil
+	}
+	c.rwLock.Lock()
+	if !c.dirty {
+		c.rwLock.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	c.dirty = false
+	c.rwLock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpFile := c.fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, c.fileName)
+}
+
+func (c *HashCache) get(filename, algo string, fi os.FileInfo, dev, ino uint64) (string, bool) {
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	entry, ok := c.entries[filename]
+	if !ok || entry.Dev != dev || entry.Ino != ino || entry.Size != fi.Size() || entry.MTime != fi.ModTime().UnixNano() {
+		return "", false
+	}
+	fileHash, ok := entry.Hashes[algo]
+	return fileHash, ok
+}
+
+func (c *HashCache) put(filename, algo, fileHash string, fi os.FileInfo, dev, ino uint64) {
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	entry, ok := c.entries[filename]
+	if !ok || entry.Dev != dev || entry.Ino != ino || entry.Size != fi.Size() || entry.MTime != fi.ModTime().UnixNano() {
+		entry = &HashCacheEntry{
+			Dev:    dev,
+			Ino:    ino,
+			Size:   fi.Size(),
+			MTime:  fi.ModTime().UnixNano(),
+			Hashes: make(map[string]string),
+		}
+		c.entries[filename] = entry
+	}
+	entry.Hashes[algo] = fileHash
+	c.dirty = true
+}
+
+// return fileLen,hash, error
+func (c *HashCache) GetFileHash(algo, filename string) (uint32, string, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return uint32(0), "", err
+	}
+	dev, ino, err := GetFileId(filename, fi)
+	if err != nil {
+		return GetFileHash(algo, filename)
+	}
+	fileHash, ok := c.get(filename, algo, fi, dev, ino)
+	if ok {
+		return uint32(fi.Size()), fileHash, nil
+	}
+	fileLen, fileHash, err := GetFileHash(algo, filename)
+	if err != nil {
+		return fileLen, fileHash, err
+	}
+	// file may be changed while hashing,only cache it if not
+	newFi, err := os.Stat(filename)
+	if err == nil && newFi.Size() == fi.Size() && newFi.ModTime().Equal(fi.ModTime()) {
+		c.put(filename, algo, fileHash, fi, dev, ino)
+	}
+	return fileLen, fileHash, nil
+}
+
+// PutFileHash remember hash of file which content is known,eg. just written
+func (c *HashCache) PutFileHash(algo, filename, fileHash string) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	dev, ino, err := GetFileId(filename, fi)
+	if err != nil {
+		return
+	}
+	c.put(filename, algo, fileHash, fi, dev, ino)
+}
+
+// Invalidate remove file, or all files in dir, from cache
+func (c *HashCache) Invalidate(filename string) {
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	_, ok := c.entries[filename]
+	if ok {
+		delete(c.entries, filename)
+		c.dirty = true
+		return
+	}
+	// not a cached file,maybe a dir
+	prefix := strings.TrimRight(filename, string(filepath.Separator)) + string(filepath.Separator)
+	for name := range c.entries {
+		if strings.HasPrefix(name, prefix) {
+			delete(c.entries, name)
+			c.dirty = true
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := filepath.Join(tmpDir, "a.txt")
+	ioutil.WriteFile(fileName, []byte("hello world."), 0644)
+
+	cacheFile := filepath.Join(tmpDir, "hash.cache")
+	cache := NewHashCache(cacheFile)
+	_, fileHash, err := cache.GetFileHash(HASH_ALGO_SHA256, fileName)
+	if err != nil {
+		t.Fatalf("GetFileHash failed,err:%s", err.Error())
+	}
+	err = cache.Save()
+	if err != nil {
+		t.Fatalf("Save failed,err:%s", err.Error())
+	}
+
+	newCache := NewHashCache(cacheFile)
+	err = newCache.Load()
+	if err != nil {
+		t.Fatalf("Load failed,err:%s", err.Error())
+	}
+	fi, _ := os.Stat(fileName)
+	dev, ino, _ := GetFileId(fileName, fi)
+	cacheHash, ok := newCache.get(fileName, HASH_ALGO_SHA256, fi, dev, ino)
+	if !ok || cacheHash != fileHash {
+		t.Fatalf("hash not found in loaded cache,hash:%s", cacheHash)
+	}
+
+	newCache.Invalidate(tmpDir)
+	_, ok = newCache.get(fileName, HASH_ALGO_SHA256, fi, dev, ino)
+	if ok {
+		t.Fatalf("hash found after dir invalidated")
+	}
+}
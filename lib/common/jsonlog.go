@@ -0,0 +1,65 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// JsonLogger append one json object per line to file
+type JsonLogger struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+var (
+	// structured log,disabled if nil
+	GJsonLog *JsonLogger
+)
+
+func NewJsonLogger(filename string) (*JsonLogger, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonLogger{file: f}, nil
+}
+
+// Log write fields with time as one line,nothing is done if l is nil
+func (l *JsonLogger) Log(fields map[string]interface{}) error {
+	if l == nil {
+		return nil
+	}
+	if _, ok := fields["time"]; !ok {
+		fields["time"] = time.Now().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *JsonLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// LogJson write msg with level and fields to GJsonLog,eg.
+// LogJson("info", "send", map[string]interface{}{"client": ip, "path": relPath})
+func LogJson(level, msg string, fields map[string]interface{}) {
+	if GJsonLog == nil {
+		return
+	}
+	fields["level"] = level
+	fields["msg"] = msg
+	GJsonLog.Log(fields)
+}
@@ -0,0 +1,21 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wlibo666/common-lib/log"
+)
+
+// StartMetricsListener serve prometheus metrics on /metrics of addr
+func StartMetricsListener(addr string) {
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		log.Logger.Info("metrics listen on:%s", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Logger.Error("metrics listen on:%s failed,err:%s", addr, err.Error())
+		}
+	}()
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	reuse "github.com/jbenet/go-reuseport"
@@ -15,24 +16,53 @@ import (
 const (
 	MSG_HEADER_LEN = 8
 	DIAL_TIMEOUT   = time.Duration(5)
+
+	// seconds to finish in-flight work when shutdown
+	DEFAULT_SHUTDOWN_TIMEOUT = 30
 )
 
 type NetHandle func(conn net.Conn) error
 
+var (
+	listeners    = make([]net.Listener, 0)
+	listenerLock = sync.Mutex{}
+	listenClosed = false
+	// conns being handled
+	connWg = sync.WaitGroup{}
+)
+
+// StartListen accept conns and handle them,it return after CloseListeners is called
 func StartListen(addr string, handle NetHandle) {
 	ln, err := reuse.Listen("tcp", addr)
 	if err != nil {
 		log.Logger.Error("Listen [%s] failed,err:%s", addr, err.Error())
 		os.Exit(1)
 	}
+	listenerLock.Lock()
+	if listenClosed {
+		listenerLock.Unlock()
+		ln.Close()
+		return
+	}
+	listeners = append(listeners, ln)
+	listenerLock.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			listenerLock.Lock()
+			closed := listenClosed
+			listenerLock.Unlock()
+			if closed {
+				log.Logger.Info("Listener:%s closed", addr)
+				return
+			}
 			log.Logger.Error("Listener:%s Accept failed,err:%s", addr, err.Error())
 			continue
 		}
+		connWg.Add(1)
 		go func(conn net.Conn) {
+			defer connWg.Done()
 			defer conn.Close()
 			err := handle(conn)
 			if err != nil {
@@ -42,6 +72,32 @@ func StartListen(addr string, handle NetHandle) {
 	}
 }
 
+// CloseListeners stop accepting new conns of all listeners
+func CloseListeners() {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	listenClosed = true
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	listeners = listeners[:0]
+}
+
+// WaitConns wait conns being handled done in timeout,return false if timeout
+func WaitConns(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		connWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func ReadMsg(conn net.Conn) ([]byte, error) {
 	dataLen := make([]byte, MSG_HEADER_LEN)
 	_, err := conn.Read(dataLen)
@@ -90,3 +146,16 @@ func WriteMsg(data []byte, conn net.Conn) error {
 	}
 	return nil
 }
+
+// CheckAddr return error if addr of option name is not host:port with valid port
+func CheckAddr(name, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid %s:%s,err:%s", name, addr, err.Error())
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 {
+		return fmt.Errorf("invalid %s:%s,err:invalid port", name, addr)
+	}
+	return nil
+}
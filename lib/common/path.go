@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// NormalizeRootName return slash separated dir without trailing slash,
+// so that windows and linux peers can compare sync roots
+func NormalizeRootName(dir string) string {
+	return strings.TrimRight(strings.Replace(dir, "\\", "/", -1), "/")
+}
+
+// IsSubDir return true if dir is parent or in parent,eg. /data/a is in /data
+func IsSubDir(parent, dir string) bool {
+	parent = NormalizeRootName(parent)
+	dir = NormalizeRootName(dir)
+	return dir == parent || strings.HasPrefix(dir, parent+"/")
+}
+
+// CheckRelPath reject slash separated relative path which may escape from its root,
+// backslash and volume name are rejected too,windows takes them as separator and root
+func CheckRelPath(relPath string) error {
+	if relPath == "" {
+		return fmt.Errorf("empty relative path")
+	}
+	if strings.HasPrefix(relPath, "/") {
+		return fmt.Errorf("relative path:%s is absolute", relPath)
+	}
+	if strings.Contains(relPath, "\\") {
+		return fmt.Errorf("relative path:%s has '\\'", relPath)
+	}
+	if (len(relPath) >= 2 && relPath[1] == ':') || filepath.VolumeName(filepath.FromSlash(relPath)) != "" {
+		return fmt.Errorf("relative path:%s has volume name", relPath)
+	}
+	for _, part := range strings.Split(relPath, "/") {
+		if part == ".." {
+			return fmt.Errorf("relative path:%s has '..'", relPath)
+		}
+	}
+	return nil
+}
+
+// JoinRelPath return file of slash separated relPath under dir,
+// error if relPath is invalid or the joined file is not in dir
+func JoinRelPath(dir, relPath string) (string, error) {
+	err := CheckRelPath(relPath)
+	if err != nil {
+		return "", err
+	}
+	cleanDir := filepath.Clean(dir)
+	file := filepath.Join(cleanDir, filepath.FromSlash(relPath))
+	tmpPath, err := filepath.Rel(cleanDir, file)
+	if err != nil || tmpPath == ".." || strings.HasPrefix(tmpPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("relative path:%s escapes from dir:%s", relPath, dir)
+	}
+	return file, nil
+}
@@ -0,0 +1,39 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJoinRelPath(t *testing.T) {
+	dir := filepath.FromSlash("/data/src")
+	cases := []struct {
+		relPath string
+		want    string
+		ok      bool
+	}{
+		{"a/b.go", filepath.FromSlash("/data/src/a/b.go"), true},
+		{"a//b.go", filepath.FromSlash("/data/src/a/b.go"), true},
+		{"a/./b.go", filepath.FromSlash("/data/src/a/b.go"), true},
+		{"a/..b.go", filepath.FromSlash("/data/src/a/..b.go"), true},
+		{"", "", false},
+		{"/etc/passwd", "", false},
+		{"../etc/passwd", "", false},
+		{"a/../../etc/passwd", "", false},
+		{"..\\..\\Windows\\x", "", false},
+		{"a\\..\\..\\x", "", false},
+		{"C:foo", "", false},
+		{"C:/Windows/x", "", false},
+		{"//server/share/x", "", false},
+		{"\\\\server\\share\\x", "", false},
+	}
+	for _, c := range cases {
+		file, err := JoinRelPath(dir, c.relPath)
+		if c.ok && (err != nil || file != c.want) {
+			t.Fatalf("JoinRelPath(%s) is %s,err:%v,want %s", c.relPath, file, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("JoinRelPath(%s) is %s,want error", c.relPath, file)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyReload relay SIGHUP to c
+func NotifyReload(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGHUP)
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package common
+
+import (
+	"os"
+)
+
+// NotifyReload do nothing,there is no SIGHUP on windows
+func NotifyReload(c chan os.Signal) {
+}
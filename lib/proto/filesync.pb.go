@@ -28,13 +28,24 @@ var _ = math.Inf
 const _ = proto1.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type FileSyncProto struct {
-	Version          *uint32 `protobuf:"varint,1,req,name=Version" json:"Version,omitempty"`
-	MsgType          *uint32 `protobuf:"varint,2,req,name=MsgType" json:"MsgType,omitempty"`
-	FileName         *string `protobuf:"bytes,3,opt,name=FileName" json:"FileName,omitempty"`
-	FileMd5          *string `protobuf:"bytes,4,opt,name=FileMd5" json:"FileMd5,omitempty"`
-	ContentLen       *uint32 `protobuf:"varint,5,req,name=ContentLen" json:"ContentLen,omitempty"`
-	Content          []byte  `protobuf:"bytes,6,opt,name=Content" json:"Content,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Version          *uint32  `protobuf:"varint,1,req,name=Version" json:"Version,omitempty"`
+	MsgType          *uint32  `protobuf:"varint,2,req,name=MsgType" json:"MsgType,omitempty"`
+	FileName         *string  `protobuf:"bytes,3,opt,name=FileName" json:"FileName,omitempty"`
+	FileMd5          *string  `protobuf:"bytes,4,opt,name=FileMd5" json:"FileMd5,omitempty"`
+	ContentLen       *uint32  `protobuf:"varint,5,req,name=ContentLen" json:"ContentLen,omitempty"`
+	Content          []byte   `protobuf:"bytes,6,opt,name=Content" json:"Content,omitempty"`
+	HashAlgo         *string  `protobuf:"bytes,7,opt,name=HashAlgo" json:"HashAlgo,omitempty"`
+	FileHash         *string  `protobuf:"bytes,8,opt,name=FileHash" json:"FileHash,omitempty"`
+	RootName         *string  `protobuf:"bytes,9,opt,name=RootName" json:"RootName,omitempty"`
+	RelPath          *string  `protobuf:"bytes,10,opt,name=RelPath" json:"RelPath,omitempty"`
+	ClientId         *string  `protobuf:"bytes,11,opt,name=ClientId" json:"ClientId,omitempty"`
+	ListenAddr       *string  `protobuf:"bytes,12,opt,name=ListenAddr" json:"ListenAddr,omitempty"`
+	Roots            []string `protobuf:"bytes,13,rep,name=Roots" json:"Roots,omitempty"`
+	Caps             []string `protobuf:"bytes,14,rep,name=Caps" json:"Caps,omitempty"`
+	Seq              *uint32  `protobuf:"varint,15,opt,name=Seq" json:"Seq,omitempty"`
+	Token            *string  `protobuf:"bytes,16,opt,name=Token" json:"Token,omitempty"`
+	Nonce            *string  `protobuf:"bytes,17,opt,name=Nonce" json:"Nonce,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (m *FileSyncProto) Reset()                    { *m = FileSyncProto{} }
@@ -84,6 +95,83 @@ func (m *FileSyncProto) GetContent() []byte {
 	return nil
 }
 
+func (m *FileSyncProto) GetHashAlgo() string {
+	if m != nil && m.HashAlgo != nil {
+		return *m.HashAlgo
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetFileHash() string {
+	if m != nil && m.FileHash != nil {
+		return *m.FileHash
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetRootName() string {
+	if m != nil && m.RootName != nil {
+		return *m.RootName
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetRelPath() string {
+	if m != nil && m.RelPath != nil {
+		return *m.RelPath
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetClientId() string {
+	if m != nil && m.ClientId != nil {
+		return *m.ClientId
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetListenAddr() string {
+	if m != nil && m.ListenAddr != nil {
+		return *m.ListenAddr
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetRoots() []string {
+	if m != nil {
+		return m.Roots
+	}
+	return nil
+}
+
+func (m *FileSyncProto) GetCaps() []string {
+	if m != nil {
+		return m.Caps
+	}
+	return nil
+}
+
+func (m *FileSyncProto) GetSeq() uint32 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *FileSyncProto) GetToken() string {
+	if m != nil && m.Token != nil {
+		return *m.Token
+	}
+	return ""
+}
+
+func (m *FileSyncProto) GetNonce() string {
+	if m != nil && m.Nonce != nil {
+		return *m.Nonce
+	}
+	return ""
+}
+
 func init() {
 	proto1.RegisterType((*FileSyncProto)(nil), "proto.FileSyncProto")
 }
@@ -91,15 +179,24 @@ func init() {
 func init() { proto1.RegisterFile("filesync.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 157 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0x4b, 0xcb, 0xcc, 0x49,
-	0x2d, 0xae, 0xcc, 0x4b, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x53, 0x4a, 0x9b,
-	0x19, 0xb9, 0x78, 0xdd, 0x32, 0x73, 0x52, 0x83, 0x2b, 0xf3, 0x92, 0x03, 0xc0, 0x12, 0x12, 0x5c,
-	0xec, 0x61, 0xa9, 0x45, 0xc5, 0x99, 0xf9, 0x79, 0x12, 0x8c, 0x0a, 0x4c, 0x1a, 0xbc, 0x41, 0x30,
-	0x2e, 0x48, 0xc6, 0xb7, 0x38, 0x3d, 0xa4, 0xb2, 0x20, 0x55, 0x82, 0x09, 0x22, 0x03, 0xe5, 0x0a,
-	0x49, 0x71, 0x71, 0x80, 0x0c, 0xf1, 0x4b, 0xcc, 0x4d, 0x95, 0x60, 0x56, 0x60, 0xd4, 0xe0, 0x0c,
-	0x82, 0xf3, 0x41, 0xba, 0x40, 0x6c, 0xdf, 0x14, 0x53, 0x09, 0x16, 0xb0, 0x14, 0x8c, 0x2b, 0x24,
-	0xc7, 0xc5, 0xe5, 0x9c, 0x9f, 0x57, 0x92, 0x9a, 0x57, 0xe2, 0x93, 0x9a, 0x27, 0xc1, 0x0a, 0x36,
-	0x12, 0x49, 0x04, 0xa4, 0x13, 0xca, 0x93, 0x60, 0x53, 0x60, 0xd4, 0xe0, 0x09, 0x82, 0x71, 0x01,
-	0x01, 0x00, 0x00, 0xff, 0xff, 0x2a, 0x82, 0xc7, 0x6d, 0xcd, 0x00, 0x00, 0x00,
+	// 289 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4c, 0x8f, 0x31, 0x4f, 0xc3, 0x30,
+	0x10, 0x85, 0x95, 0xa6, 0xa1, 0x8d, 0x69, 0x4a, 0xb1, 0x18, 0x4e, 0x0c, 0x28, 0x62, 0xca, 0xc4,
+	0xc6, 0x0f, 0xa8, 0x22, 0x21, 0x90, 0xda, 0xaa, 0x72, 0x2b, 0xf6, 0x28, 0x39, 0xda, 0x08, 0x63,
+	0x87, 0xd8, 0x4b, 0x7e, 0x20, 0xff, 0x0b, 0x9d, 0x1d, 0x43, 0x27, 0xdf, 0xf7, 0x9e, 0xde, 0xdd,
+	0x33, 0x5b, 0x7e, 0xb4, 0x12, 0xcd, 0xa0, 0xea, 0xa7, 0xae, 0xd7, 0x56, 0xf3, 0xc4, 0x3d, 0x8f,
+	0x3f, 0x31, 0xcb, 0x5e, 0x5a, 0x89, 0x87, 0x41, 0xd5, 0x7b, 0x67, 0x00, 0x9b, 0xbd, 0x63, 0x6f,
+	0x5a, 0xad, 0x20, 0xca, 0x27, 0x45, 0x26, 0x02, 0x92, 0xb3, 0x35, 0xa7, 0xe3, 0xd0, 0x21, 0x4c,
+	0xbc, 0x33, 0x22, 0xbf, 0x67, 0x73, 0x5a, 0xb2, 0xab, 0xbe, 0x10, 0xe2, 0x3c, 0x2a, 0x52, 0xf1,
+	0xc7, 0x94, 0xa2, 0x79, 0xdb, 0x3c, 0xc3, 0xd4, 0x59, 0x01, 0xf9, 0x03, 0x63, 0xa5, 0x56, 0x16,
+	0x95, 0xdd, 0xa0, 0x82, 0xc4, 0xad, 0xbc, 0x50, 0x28, 0x39, 0x12, 0x5c, 0xe5, 0x51, 0xb1, 0x10,
+	0x01, 0xe9, 0xde, 0x6b, 0x65, 0xce, 0x6b, 0x79, 0xd2, 0x30, 0xf3, 0xf7, 0x02, 0x87, 0x2e, 0xc4,
+	0x30, 0xff, 0xef, 0x42, 0x4c, 0x9e, 0xd0, 0xda, 0xba, 0x9e, 0xa9, 0xf7, 0x02, 0xd3, 0x35, 0x81,
+	0x72, 0x5f, 0xd9, 0x33, 0x30, 0xdf, 0x73, 0x44, 0x4a, 0x95, 0xb2, 0x45, 0x65, 0xdf, 0x1a, 0xb8,
+	0xf6, 0xa9, 0xc0, 0xf4, 0x87, 0x4d, 0x6b, 0x2c, 0xaa, 0x75, 0xd3, 0xf4, 0xb0, 0x70, 0xee, 0x85,
+	0xc2, 0xef, 0x58, 0x42, 0x17, 0x0c, 0x64, 0x79, 0x5c, 0xa4, 0xc2, 0x03, 0xe7, 0x6c, 0x5a, 0x56,
+	0x9d, 0x81, 0xa5, 0x13, 0xdd, 0xcc, 0x57, 0x2c, 0x3e, 0xe0, 0x37, 0xdc, 0xe4, 0x51, 0x91, 0x09,
+	0x1a, 0x29, 0x7b, 0xd4, 0x9f, 0xa8, 0x60, 0xe5, 0xd6, 0x7a, 0x20, 0x75, 0xa7, 0x55, 0x8d, 0x70,
+	0xeb, 0x55, 0x07, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x3a, 0xc1, 0xea, 0x05, 0xdf, 0x01, 0x00,
+	0x00,
 }
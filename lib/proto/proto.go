@@ -2,12 +2,16 @@ package proto
 
 import (
 	"net"
+	"time"
 
 	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
 )
 
 var (
-	PROTO_VERSION = uint32(1)
+	// version 2 send RootName and RelPath instead of absolute FileName
+	PROTO_VERSION    = uint32(2)
+	PROTO_VERSION_V1 = uint32(1)
 
 	PROTO_MSG_FILE_CREATE_REQ = uint32(1001)
 	PROTO_MSG_FILE_WRITE_REQ  = uint32(1002)
@@ -15,16 +19,23 @@ var (
 	PROTO_MSG_FILE_RENAME_REQ = uint32(1004)
 	PROTO_MSG_FILE_CHMOD_REQ  = uint32(1005)
 	PROTO_MSG_FILE_EXIST_REQ  = uint32(1006)
+	PROTO_MSG_SNAPSHOT_REQ    = uint32(1008)
+	// client request, sent to heartbeat port
+	PROTO_MSG_FILE_FETCH_REQ = uint32(1007)
+	PROTO_MSG_FILE_LIST_REQ  = uint32(1009)
 
 	PROTO_MSG_COMMON_RESP_OK   = uint32(2000)
 	PROTO_MSG_COMMON_RESP_FAIL = uint32(2001)
 	PROTO_MSG_HEART_BETA_REQ   = uint32(3000)
 	PROTO_MSG_HEART_BETA_RES   = uint32(3001)
+	// heartbeat of single port client,server push msgs to client on its heartbeat conn
+	PROTO_MSG_HEART_BETA_PUSH_REQ = uint32(3002)
 
 	PROTO_DIR_LEN  = uint32(0)
 	PROTO_FILE_LEN = uint32(1)
 )
 
+// defaults of sync_workers, max_retry, heartbeat_interval and heartbeat_port in config
 const (
 	SYNC_FILE_NUM_ONETIME    = 30
 	MAX_RETRY_TIME           = 30
@@ -32,6 +43,23 @@ const (
 	HEART_BEAT_LISTENER_PORT = 6001
 )
 
+// capabilities announced by client in heartbeat
+const (
+	// client is in single port mode
+	CAP_SINGLE_PORT = "single_port"
+	// client takes snapshot when server ask
+	CAP_SNAPSHOT = "snapshot"
+)
+
+// ListEntry is one file of root in content of list response,
+// Hash is empty for dir
+type ListEntry struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir,omitempty"`
+	Len  int64  `json:"len"`
+	Hash string `json:"hash,omitempty"`
+}
+
 func GetMsgName(msgType uint32) string {
 	switch msgType {
 	case PROTO_MSG_FILE_CREATE_REQ:
@@ -46,6 +74,12 @@ func GetMsgName(msgType uint32) string {
 		return "chmodReq"
 	case PROTO_MSG_FILE_EXIST_REQ:
 		return "existReq"
+	case PROTO_MSG_FILE_FETCH_REQ:
+		return "fetchReq"
+	case PROTO_MSG_FILE_LIST_REQ:
+		return "listReq"
+	case PROTO_MSG_SNAPSHOT_REQ:
+		return "snapshotReq"
 	case PROTO_MSG_COMMON_RESP_OK:
 		return "respOk"
 	case PROTO_MSG_COMMON_RESP_FAIL:
@@ -54,6 +88,8 @@ func GetMsgName(msgType uint32) string {
 		return "heartBeatReq"
 	case PROTO_MSG_HEART_BETA_RES:
 		return "heartBeatResp"
+	case PROTO_MSG_HEART_BETA_PUSH_REQ:
+		return "heartBeatPushReq"
 	default:
 		return "unknownMsg"
 	}
@@ -61,6 +97,28 @@ func GetMsgName(msgType uint32) string {
 }
 
 func LogMsg(conn net.Conn, msg *FileSyncProto) {
-	log.Logger.Debug("conn:%s,version:%d,msgType:%d,msgName:%s,filename:%s,filemd5:%s,contentLen:%d", conn.RemoteAddr().String(),
-		msg.GetVersion(), msg.GetMsgType(), GetMsgName(msg.GetMsgType()), msg.GetFileName(), msg.GetFileMd5(), msg.GetContentLen())
+	log.Logger.Debug("conn:%s,version:%d,msgType:%d,msgName:%s,filename:%s,root:%s,relPath:%s,filemd5:%s,hashAlgo:%s,fileHash:%s,contentLen:%d", conn.RemoteAddr().String(),
+		msg.GetVersion(), msg.GetMsgType(), GetMsgName(msg.GetMsgType()), msg.GetFileName(), msg.GetRootName(), msg.GetRelPath(),
+		msg.GetFileMd5(), msg.GetHashAlgo(), msg.GetFileHash(), msg.GetContentLen())
+}
+
+// LogMsgJson write structured log of msg sent to or applied from peer
+func LogMsgJson(action, peer string, msg *FileSyncProto, start time.Time, err error) {
+	fields := map[string]interface{}{
+		"peer":     peer,
+		"root":     msg.GetRootName(),
+		"path":     msg.GetRelPath(),
+		"op":       GetMsgName(msg.GetMsgType()),
+		"bytes":    len(msg.GetContent()),
+		"duration": time.Since(start).Seconds(),
+	}
+	if msg.GetRootName() == "" {
+		fields["path"] = msg.GetFileName()
+	}
+	level := "info"
+	if err != nil {
+		level = "error"
+		fields["err"] = err.Error()
+	}
+	common.LogJson(level, action, fields)
 }
@@ -2,42 +2,280 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path"
 	"strings"
+	"sync/atomic"
 
+	"github.com/wlibo666/common-lib/log"
 	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
 )
 
 type FileSyncMoniConf struct {
+	Name      string   `json:"name"`
 	DirName   string   `json:"dir"`
 	WhiteList []string `json:"white_list"`
+	// ask clients to take snapshot every snapshot_interval seconds
+	SnapshotInterval int `json:"snapshot_interval"`
+	// limit bytes sent of this dir to all clients
+	RateLimit *RateLimitConf `json:"rate_limit"`
 }
 
+// GetName return root name sent to client,default is the normalized dir
+func (moni *FileSyncMoniConf) GetName() string {
+	if moni.Name != "" {
+		return moni.Name
+	}
+	return common.NormalizeRootName(moni.DirName)
+}
+
+const (
+	// seconds an event of higher priority overtakes,per priority level
+	DEFAULT_PRIORITY_BOOST = 60
+)
+
 type FileSyncServerConf struct {
-	ListenAddr string              `json:"listen"`
-	DebugFlag  bool                `json:"debug"`
-	LogFile    string              `json:"log_file"`
-	LogFileNum int                 `json:"log_file_num"`
-	MoniDirs   []*FileSyncMoniConf `json:"moni_dir"`
+	ListenAddr      string `json:"listen"`
+	DebugFlag       bool   `json:"debug"`
+	LogFile         string `json:"log_file"`
+	LogFileNum      int    `json:"log_file_num"`
+	HashAlgo        string `json:"hash_algo"`
+	HashCache       string `json:"hash_cache"`
+	MetricsListen   string `json:"metrics_listen"`
+	JsonLog         string `json:"json_log"`
+	ShutdownTimeout int    `json:"shutdown_timeout"`
+	PendingEvents   string `json:"pending_events"`
+	EventWal        string `json:"event_wal"`
+	// http admin api listen address,eg: 127.0.0.1:6002,disabled if empty
+	AdminListen       string              `json:"admin_listen"`
+	HeartBeatPort     int                 `json:"heartbeat_port"`
+	HeartBeatInterval int                 `json:"heartbeat_interval"`
+	MaxRetry          int                 `json:"max_retry"`
+	SyncWorkers       int                 `json:"sync_workers"`
+	RateLimit         *RateLimitConf      `json:"rate_limit"`
+	ClientRateLimit   *RateLimitConf      `json:"client_rate_limit"`
+	HighPriority      []string            `json:"high_priority"`
+	PriorityBoost     int                 `json:"priority_boost"`
+	ClientSecrets     map[string]string   `json:"client_secrets"`
+	MoniDirs          []*FileSyncMoniConf `json:"moni_dir"`
+}
+
+// GetLostSeconds return seconds without heartbeat after which client is lost
+func (conf *FileSyncServerConf) GetLostSeconds() int64 {
+	return int64(conf.MaxRetry * conf.HeartBeatInterval)
 }
 
 var (
-	GServerConf = &FileSyncServerConf{}
+	// running config,replaced when reload
+	serverConf = atomic.Value{}
+	// config file loaded,read again when reload
+	ConfFileName = ""
 )
 
+func init() {
+	serverConf.Store(&FileSyncServerConf{})
+}
+
+// GetServerConf return running config,it is safe to call while config is reloaded
+func GetServerConf() *FileSyncServerConf {
+	return serverConf.Load().(*FileSyncServerConf)
+}
+
+// SetServerConf replace running config
+func SetServerConf(conf *FileSyncServerConf) {
+	serverConf.Store(conf)
+}
+
+// parseConfig read and check config file
+func parseConfig(filename string) (*FileSyncServerConf, error) {
+	conf := &FileSyncServerConf{}
+	err := common.LoadConf(filename, conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = common.DEFAULT_SHUTDOWN_TIMEOUT
+	}
+	if conf.HeartBeatPort <= 0 {
+		conf.HeartBeatPort = syncproto.HEART_BEAT_LISTENER_PORT
+	}
+	if conf.HeartBeatInterval <= 0 {
+		conf.HeartBeatInterval = syncproto.HEART_BEAT_INTERVAL
+	}
+	if conf.MaxRetry <= 0 {
+		conf.MaxRetry = syncproto.MAX_RETRY_TIME
+	}
+	if conf.SyncWorkers <= 0 {
+		conf.SyncWorkers = syncproto.SYNC_FILE_NUM_ONETIME
+	}
+	if conf.PriorityBoost <= 0 {
+		conf.PriorityBoost = DEFAULT_PRIORITY_BOOST
+	}
+	if conf.HashAlgo != "" && !common.IsSupportHashAlgo(conf.HashAlgo) {
+		return nil, fmt.Errorf("unsupport hash_algo:%s", conf.HashAlgo)
+	}
+	for _, pattern := range conf.HighPriority {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid high_priority pattern:%s", pattern)
+		}
+	}
+	if err = conf.RateLimit.check("rate_limit"); err != nil {
+		return nil, err
+	}
+	if err = conf.ClientRateLimit.check("client_rate_limit"); err != nil {
+		return nil, err
+	}
+	for _, moni := range conf.MoniDirs {
+		if err = moni.RateLimit.check("rate_limit of dir:" + moni.DirName); err != nil {
+			return nil, err
+		}
+	}
+	return conf, nil
+}
+
 func LoadConfig(filename string) error {
-	return common.LoadConf(filename, GServerConf)
+	conf, err := parseConfig(filename)
+	if err != nil {
+		return err
+	}
+	SetServerConf(conf)
+	ConfFileName = filename
+	return nil
 }
 
-func IsInWhiteList(ipAddr string) bool {
-	for _, dir := range GServerConf.MoniDirs {
-		for _, addr := range dir.WhiteList {
-			if ipAddr == strings.Split(addr, ":")[0] {
-				return true
+// ReloadConfig read config file again and check its moni dirs like -check-config,
+// options which need restart keep running value
+func ReloadConfig() (*FileSyncServerConf, error) {
+	conf, err := parseConfig(ConfFileName)
+	if err != nil {
+		return nil, err
+	}
+	// a typo in moni_dir would leave its root unwatched
+	if errs := checkMoniDirs(conf); len(errs) > 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, fmt.Errorf("invalid moni_dir:%s", strings.Join(msgs, ";"))
+	}
+	oldConf := GetServerConf()
+	if conf.ListenAddr != oldConf.ListenAddr || conf.LogFile != oldConf.LogFile ||
+		conf.LogFileNum != oldConf.LogFileNum || conf.HashCache != oldConf.HashCache ||
+		conf.MetricsListen != oldConf.MetricsListen || conf.AdminListen != oldConf.AdminListen ||
+		conf.JsonLog != oldConf.JsonLog || conf.PendingEvents != oldConf.PendingEvents ||
+		conf.HeartBeatPort != oldConf.HeartBeatPort || conf.SyncWorkers != oldConf.SyncWorkers ||
+		conf.EventWal != oldConf.EventWal {
+		log.Logger.Warn("listen,log_file,log_file_num,hash_cache,metrics_listen,admin_listen,json_log,pending_events,heartbeat_port,sync_workers and event_wal need restart to change")
+	}
+	conf.ListenAddr = oldConf.ListenAddr
+	conf.LogFile = oldConf.LogFile
+	conf.LogFileNum = oldConf.LogFileNum
+	conf.HashCache = oldConf.HashCache
+	conf.MetricsListen = oldConf.MetricsListen
+	conf.AdminListen = oldConf.AdminListen
+	conf.JsonLog = oldConf.JsonLog
+	conf.PendingEvents = oldConf.PendingEvents
+	conf.HeartBeatPort = oldConf.HeartBeatPort
+	conf.SyncWorkers = oldConf.SyncWorkers
+	conf.EventWal = oldConf.EventWal
+	return conf, nil
+}
+
+// CheckConfig return problems of config file,eg. unknown keys,invalid addresses,
+// missing or overlapping moni dirs and duplicate clients
+func CheckConfig(filename string) []error {
+	conf, err := parseConfig(filename)
+	if err != nil {
+		return []error{err}
+	}
+	errs := make([]error, 0)
+	keys, err := common.CheckConfKeys(filename, conf)
+	if err != nil {
+		return []error{err}
+	}
+	for _, key := range keys {
+		errs = append(errs, fmt.Errorf("unknown key:%s", key))
+	}
+	if err = common.CheckAddr("listen", conf.ListenAddr); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.AdminListen != "" {
+		if err = common.CheckAddr("admin_listen", conf.AdminListen); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.MetricsListen != "" {
+		if err = common.CheckAddr("metrics_listen", conf.MetricsListen); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if conf.HeartBeatPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid heartbeat_port:%d", conf.HeartBeatPort))
+	}
+	return append(errs, checkMoniDirs(conf)...)
+}
+
+// checkMoniDirs return problems of moni dirs,eg. missing or overlapping dirs and duplicate clients
+func checkMoniDirs(conf *FileSyncServerConf) []error {
+	errs := make([]error, 0)
+	if len(conf.MoniDirs) == 0 {
+		errs = append(errs, fmt.Errorf("moni_dir is empty"))
+	}
+	names := make(map[string]bool)
+	for i, moni := range conf.MoniDirs {
+		fi, err := os.Stat(moni.DirName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dir:%s not exist,err:%s", moni.DirName, err.Error()))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("dir:%s is not a dir", moni.DirName))
+		}
+		if names[moni.GetName()] {
+			errs = append(errs, fmt.Errorf("duplicate name:%s of dir:%s", moni.GetName(), moni.DirName))
+		}
+		names[moni.GetName()] = true
+		for _, other := range conf.MoniDirs[:i] {
+			if common.IsSubDir(other.DirName, moni.DirName) || common.IsSubDir(moni.DirName, other.DirName) {
+				errs = append(errs, fmt.Errorf("dir:%s overlaps dir:%s", moni.DirName, other.DirName))
+			}
+		}
+		if moni.SnapshotInterval < 0 {
+			errs = append(errs, fmt.Errorf("invalid snapshot_interval:%d of dir:%s", moni.SnapshotInterval, moni.DirName))
+		}
+		clients := make(map[string]bool)
+		for _, addr := range moni.WhiteList {
+			if err = checkClient("client of dir:"+moni.DirName, addr); err != nil {
+				errs = append(errs, err)
+			} else if isIdentity(addr) && conf.ClientSecrets[addr] == "" {
+				errs = append(errs, fmt.Errorf("client:%s of dir:%s has no client_secrets,it never matches", addr, moni.DirName))
+			}
+			if clients[addr] {
+				errs = append(errs, fmt.Errorf("duplicate client:%s of dir:%s", addr, moni.DirName))
 			}
+			clients[addr] = true
 		}
 	}
-	return false
+	return errs
+}
+
+// isIdentity return true if white list entry is identity of client,not ip:port or ip
+func isIdentity(client string) bool {
+	return net.ParseIP(client) == nil && !strings.Contains(client, ":")
+}
+
+// checkClient return error if white list entry is not ip:port,ip or identity of client
+func checkClient(name, client string) error {
+	if net.ParseIP(client) != nil {
+		return nil
+	}
+	if strings.Contains(client, ":") {
+		return common.CheckAddr(name, client)
+	}
+	if client == "" || strings.ContainsAny(client, " \t/\\") {
+		return fmt.Errorf("invalid %s:%s", name, client)
+	}
+	return nil
 }
 
 func PrintServerConf(config *FileSyncServerConf) {
@@ -45,8 +283,21 @@ func PrintServerConf(config *FileSyncServerConf) {
 	fmt.Fprintf(os.Stdout, "debug:%v\n", config.DebugFlag)
 	fmt.Fprintf(os.Stdout, "log_file:%s\n", config.LogFile)
 	fmt.Fprintf(os.Stdout, "log_file_num:%d\n", config.LogFileNum)
+	fmt.Fprintf(os.Stdout, "hash_algo:%s\n", config.HashAlgo)
+	fmt.Fprintf(os.Stdout, "hash_cache:%s\n", config.HashCache)
+	fmt.Fprintf(os.Stdout, "admin_listen:%s\n", config.AdminListen)
+	fmt.Fprintf(os.Stdout, "metrics_listen:%s\n", config.MetricsListen)
+	fmt.Fprintf(os.Stdout, "json_log:%s\n", config.JsonLog)
+	fmt.Fprintf(os.Stdout, "shutdown_timeout:%d\n", config.ShutdownTimeout)
+	fmt.Fprintf(os.Stdout, "pending_events:%s\n", config.PendingEvents)
+	fmt.Fprintf(os.Stdout, "event_wal:%s\n", config.EventWal)
+	fmt.Fprintf(os.Stdout, "heartbeat_port:%d\n", config.HeartBeatPort)
+	fmt.Fprintf(os.Stdout, "heartbeat_interval:%d\n", config.HeartBeatInterval)
+	fmt.Fprintf(os.Stdout, "max_retry:%d\n", config.MaxRetry)
+	fmt.Fprintf(os.Stdout, "sync_workers:%d\n", config.SyncWorkers)
 
 	for _, moni := range config.MoniDirs {
+		fmt.Fprintf(os.Stdout, "  name:%s\n", moni.GetName())
 		fmt.Fprintf(os.Stdout, "  dir:%s\n", moni.DirName)
 		fmt.Fprintf(os.Stdout, "  white_list:%v\n", moni.WhiteList)
 	}
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -11,5 +16,75 @@ func TestLoadConfig(t *testing.T) {
 	if err != nil {
 		t.Fatalf("LoadConfig failed,err:%s", err.Error())
 	}
-	PrintServerConf(GServerConf)
+	PrintServerConf(GetServerConf())
+}
+
+func TestCheckConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	dataDir := filepath.ToSlash(filepath.Join(tmpDir, "data"))
+	os.MkdirAll(dataDir+"/sub", os.ModePerm)
+
+	confFile := filepath.Join(tmpDir, "server.yaml")
+	ioutil.WriteFile(confFile, []byte("listen: \":6000\"\nmoni_dir:\n  - dir: "+dataDir+"\n    white_list: [\"10.0.0.1:6000\", \"10.0.0.2\", \"web-01\"]\nclient_secrets:\n  web-01: secret\n"), 0644)
+	errs := CheckConfig(confFile)
+	if len(errs) != 0 {
+		t.Fatalf("CheckConfig should pass,errs:%v", errs)
+	}
+
+	ioutil.WriteFile(confFile, []byte("listen: \"6000\"\nlog_fle: a.log\nmoni_dir:\n"+
+		"  - dir: "+dataDir+"\n    white_list: [\"10.0.0.1:6000\", \"10.0.0.1:6000\", \"web 01\", \"db-01\"]\n"+
+		"  - dir: "+dataDir+"/sub\n"+
+		"  - dir: "+filepath.ToSlash(tmpDir)+"/none\n"), 0644)
+	errs = CheckConfig(confFile)
+	expects := []string{"unknown key:log_fle", "invalid listen:6000", "duplicate client:10.0.0.1:6000",
+		"invalid client of dir:" + dataDir + ":web 01", "client:db-01 of dir:" + dataDir + " has no client_secrets",
+		"overlaps dir:" + dataDir, "/none not exist"}
+	if len(errs) != len(expects) {
+		t.Fatalf("CheckConfig got %d errs:%v", len(errs), errs)
+	}
+	for i, expect := range expects {
+		if !strings.Contains(errs[i].Error(), expect) {
+			t.Fatalf("CheckConfig errs[%d]:%s,expect:%s", i, errs[i].Error(), expect)
+		}
+	}
+}
+
+func TestRateLimitConf(t *testing.T) {
+	conf := &RateLimitConf{
+		BytesPerSec: 1000,
+		Schedules: []*RateSchedule{
+			{Start: "09:00", End: "18:00", BytesPerSec: 100, Burst: 200},
+			{Start: "22:00", End: "06:00", BytesPerSec: 0},
+		},
+	}
+	cases := []struct {
+		clock       string
+		bytesPerSec int64
+		burst       int64
+	}{
+		{"08:59", 1000, 1000},
+		{"09:00", 100, 200},
+		{"17:59", 100, 200},
+		{"18:00", 1000, 1000},
+		{"23:30", 0, 0},
+		{"05:59", 0, 0},
+	}
+	for _, c := range cases {
+		now, _ := time.Parse("15:04", c.clock)
+		bytesPerSec, burst := conf.GetRate(now)
+		if bytesPerSec != c.bytesPerSec || burst != c.burst {
+			t.Fatalf("GetRate at %s got:%d,%d,expect:%d,%d", c.clock, bytesPerSec, burst, c.bytesPerSec, c.burst)
+		}
+	}
+	var noLimit *RateLimitConf
+	if bytesPerSec, _ := noLimit.GetRate(time.Now()); bytesPerSec != 0 {
+		t.Fatalf("nil rate limit should be no limit")
+	}
+	if err := (&RateLimitConf{Schedules: []*RateSchedule{{Start: "9", End: "18:00"}}}).check("rate_limit"); err == nil {
+		t.Fatalf("check should fail with invalid schedule")
+	}
 }
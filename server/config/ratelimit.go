@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateSchedule is rate limit used from start to end of every day,eg. 09:00 to 18:00,
+// it wraps midnight if end is before start
+type RateSchedule struct {
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	BytesPerSec int64  `json:"bytes_per_sec"`
+	Burst       int64  `json:"burst"`
+}
+
+// RateLimitConf limit bytes sent per second,0 means no limit,
+// burst is bytes_per_sec if not set
+type RateLimitConf struct {
+	BytesPerSec int64           `json:"bytes_per_sec"`
+	Burst       int64           `json:"burst"`
+	Schedules   []*RateSchedule `json:"schedule"`
+}
+
+// parseDayTime return minutes of day of HH:MM
+func parseDayTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time:%s,should be HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (schedule *RateSchedule) isActive(now time.Time) bool {
+	start, err := parseDayTime(schedule.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseDayTime(schedule.End)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// GetRate return bytes per second and burst at now,first active schedule is used
+func (conf *RateLimitConf) GetRate(now time.Time) (int64, int64) {
+	if conf == nil {
+		return 0, 0
+	}
+	bytesPerSec, burst := conf.BytesPerSec, conf.Burst
+	for _, schedule := range conf.Schedules {
+		if schedule.isActive(now) {
+			bytesPerSec, burst = schedule.BytesPerSec, schedule.Burst
+			break
+		}
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return bytesPerSec, burst
+}
+
+func (conf *RateLimitConf) check(name string) error {
+	if conf == nil {
+		return nil
+	}
+	if conf.BytesPerSec < 0 || conf.Burst < 0 {
+		return fmt.Errorf("bytes_per_sec and burst of %s must not be negative", name)
+	}
+	for _, schedule := range conf.Schedules {
+		if _, err := parseDayTime(schedule.Start); err != nil {
+			return fmt.Errorf("invalid schedule start of %s,err:%s", name, err.Error())
+		}
+		if _, err := parseDayTime(schedule.End); err != nil {
+			return fmt.Errorf("invalid schedule end of %s,err:%s", name, err.Error())
+		}
+		if schedule.BytesPerSec < 0 || schedule.Burst < 0 {
+			return fmt.Errorf("bytes_per_sec and burst of schedule of %s must not be negative", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package handle
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+const (
+	// recent failures kept for admin api
+	MAX_RECENT_FAILURES = 100
+)
+
+// Failure is a failed operation shown by admin api
+type Failure struct {
+	Time   int64  `json:"time"`
+	Op     string `json:"op"`
+	File   string `json:"file"`
+	Client string `json:"client,omitempty"`
+	Err    string `json:"err"`
+}
+
+var (
+	recentFailures = make([]*Failure, 0, MAX_RECENT_FAILURES)
+	failureIndex   = 0
+	failureLock    = sync.Mutex{}
+)
+
+// recordFailure keep failure in ring buffer of recent failures
+func recordFailure(op, filename, client string, err error) {
+	failure := &Failure{
+		Time:   time.Now().Unix(),
+		Op:     op,
+		File:   filename,
+		Client: client,
+		Err:    err.Error(),
+	}
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	if len(recentFailures) < MAX_RECENT_FAILURES {
+		recentFailures = append(recentFailures, failure)
+		return
+	}
+	recentFailures[failureIndex] = failure
+	failureIndex = (failureIndex + 1) % MAX_RECENT_FAILURES
+}
+
+// getRecentFailures return recent failures,newest first
+func getRecentFailures() []*Failure {
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	failures := make([]*Failure, 0, len(recentFailures))
+	for i := len(recentFailures) - 1; i >= 0; i-- {
+		failures = append(failures, recentFailures[(failureIndex+i)%len(recentFailures)])
+	}
+	return failures
+}
+
+// ClientStatus is shown by admin api,pending is number of failed ops waiting retry
+type ClientStatus struct {
+	Ip            string `json:"ip"`
+	Online        bool   `json:"online"`
+	LastHeartBeat int64  `json:"last_heartbeat"`
+	Version       uint32 `json:"version"`
+	HashAlgo      string `json:"hash_algo"`
+	Pending       int    `json:"pending"`
+}
+
+// getClientStatus return status of clients which ever connected,sorted by ip
+func getClientStatus() []*ClientStatus {
+	clients := make([]*ClientStatus, 0)
+	clientRwLock.RLock()
+	for ip, online := range ClientsAddr {
+		clients = append(clients, &ClientStatus{
+			Ip:            ip,
+			Online:        online,
+			LastHeartBeat: HeartBeatList[ip],
+		})
+	}
+	clientRwLock.RUnlock()
+	pendings := countRetries()
+	for _, client := range clients {
+		client.Pending = pendings[client.Ip]
+		info := getClientInfo(client.Ip)
+		client.Version = info.Version
+		client.HashAlgo = info.HashAlgo
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Ip < clients[j].Ip
+	})
+	return clients
+}
+
+// getWatches return dirs watched now
+func getWatches() []string {
+	dirRwLock.RLock()
+	watches := make([]string, 0, len(moniDirNames))
+	for dir := range moniDirNames {
+		watches = append(watches, dir)
+	}
+	dirRwLock.RUnlock()
+	sort.Strings(watches)
+	return watches
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, getClientStatus())
+	})
+	mux.HandleFunc("/registrations", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, getClientRegs())
+	})
+	mux.HandleFunc("/dirs", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, config.GetServerConf().MoniDirs)
+	})
+	mux.HandleFunc("/watches", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, getWatches())
+	})
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		depths := eventQueue.depths()
+		writeJson(w, map[string]int{
+			"depth":     eventQueue.len(),
+			"high":      depths[EVENT_PRIORITY_HIGH],
+			"live":      depths[EVENT_PRIORITY_LIVE],
+			"large":     depths[EVENT_PRIORITY_LARGE],
+			"reconcile": depths[EVENT_PRIORITY_RECONCILE],
+			"capacity":  MAX_RECONCILE_EVENTS,
+			"workers":   config.GetServerConf().SyncWorkers,
+		})
+	})
+	mux.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, getRetryOps())
+	})
+	mux.HandleFunc("/failures", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, getRecentFailures())
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJson(w, map[string]bool{"ok": true})
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// StartAdminListener serve admin api in json:
+// /clients, /registrations, /dirs, /watches, /queue, /pending and /failures,and prometheus /metrics.
+// POST /reload reload config file
+func StartAdminListener(addr string) {
+	go func() {
+		log.Logger.Info("admin api listen on:%s", addr)
+		err := http.ListenAndServe(addr, newAdminMux())
+		if err != nil {
+			log.Logger.Error("admin api listen on:%s failed,err:%s", addr, err.Error())
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+package handle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+func TestRecentFailures(t *testing.T) {
+	for i := 0; i < MAX_RECENT_FAILURES+10; i++ {
+		recordFailure("writeReq", fmt.Sprintf("file%d", i), "192.168.1.104", fmt.Errorf("failed"))
+	}
+	failures := getRecentFailures()
+	if len(failures) != MAX_RECENT_FAILURES {
+		t.Fatalf("recent failures len is %d", len(failures))
+	}
+	if failures[0].File != fmt.Sprintf("file%d", MAX_RECENT_FAILURES+9) || failures[MAX_RECENT_FAILURES-1].File != "file10" {
+		t.Fatalf("recent failures is not newest first,first:%s,last:%s", failures[0].File, failures[MAX_RECENT_FAILURES-1].File)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	clientRwLock.Lock()
+	ClientsAddr["192.168.1.104"] = true
+	HeartBeatList["192.168.1.104"] = 1500000000
+	clientRwLock.Unlock()
+	defer func() {
+		clientRwLock.Lock()
+		delete(ClientsAddr, "192.168.1.104")
+		delete(HeartBeatList, "192.168.1.104")
+		clientRwLock.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(w, httptest.NewRequest("GET", "/clients", nil))
+	clients := make([]*ClientStatus, 0)
+	err := json.Unmarshal(w.Body.Bytes(), &clients)
+	if err != nil || len(clients) != 1 || !clients[0].Online || clients[0].LastHeartBeat != 1500000000 {
+		t.Fatalf("/clients response is %s,err:%v", w.Body.String(), err)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	observeMsgSent(&syncproto.FileSyncProto{
+		MsgType: proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+		Content: []byte("hello world."),
+	}, nil)
+	w := httptest.NewRecorder()
+	newAdminMux().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, metric := range []string{"filesync_server_queue_depth", "filesync_server_online_clients",
+		`filesync_server_messages_sent_total{type="writeReq"}`, "filesync_server_sent_bytes_total"} {
+		if !strings.Contains(w.Body.String(), metric) {
+			t.Fatalf("/metrics has no %s", metric)
+		}
+	}
+}
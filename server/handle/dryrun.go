@@ -0,0 +1,100 @@
+package handle
+
+import (
+	"sync"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+)
+
+// clientDryRun count ops which would be done for a client in dry run,its summary
+// is logged after dirs are walked and files queued for it are all processed
+type clientDryRun struct {
+	stats   *common.DryRunStats
+	pending map[string]bool
+	walks   int
+}
+
+var (
+	clientDryRuns    = make(map[string]*clientDryRun)
+	clientDryRunLock = sync.Mutex{}
+)
+
+func getClientDryRun(clientIp string) *clientDryRun {
+	dryRun, ok := clientDryRuns[clientIp]
+	if !ok {
+		dryRun = &clientDryRun{
+			stats:   common.NewDryRunStats(),
+			pending: make(map[string]bool),
+		}
+		clientDryRuns[clientIp] = dryRun
+	}
+	return dryRun
+}
+
+// logClientDryRun log summary of client if it is done,lock must be held
+func logClientDryRun(clientIp string) {
+	dryRun := clientDryRuns[clientIp]
+	if dryRun == nil || dryRun.walks > 0 || len(dryRun.pending) > 0 {
+		return
+	}
+	delete(clientDryRuns, clientIp)
+	log.Logger.Info("sync to client:%s done,%s", clientIp, dryRun.stats.Summary())
+}
+
+// beginDryRunWalk start walk of dir for client
+func beginDryRunWalk(clientIp string) {
+	if !common.DryRun {
+		return
+	}
+	clientDryRunLock.Lock()
+	getClientDryRun(clientIp).walks++
+	clientDryRunLock.Unlock()
+}
+
+// endDryRunWalk end walk of dir for client,summary is logged if no file is queued
+func endDryRunWalk(clientIp string) {
+	if !common.DryRun {
+		return
+	}
+	clientDryRunLock.Lock()
+	getClientDryRun(clientIp).walks--
+	logClientDryRun(clientIp)
+	clientDryRunLock.Unlock()
+}
+
+// addDryRunPending record file queued by walk for client
+func addDryRunPending(clientIp, fileName string) {
+	if !common.DryRun {
+		return
+	}
+	clientDryRunLock.Lock()
+	getClientDryRun(clientIp).pending[fileName] = true
+	clientDryRunLock.Unlock()
+}
+
+// recordClientDryRun count op which would be done for client
+func recordClientDryRun(clientIp, op string, bytes int) {
+	common.DryRunRecord(op, bytes)
+	clientDryRunLock.Lock()
+	dryRun, ok := clientDryRuns[clientIp]
+	clientDryRunLock.Unlock()
+	if ok {
+		dryRun.stats.Record(op, bytes)
+	}
+}
+
+// doneDryRunEvent mark file processed for all clients waiting it
+func doneDryRunEvent(fileName string) {
+	if !common.DryRun {
+		return
+	}
+	clientDryRunLock.Lock()
+	for clientIp, dryRun := range clientDryRuns {
+		if dryRun.pending[fileName] {
+			delete(dryRun.pending, fileName)
+			logClientDryRun(clientIp)
+		}
+	}
+	clientDryRunLock.Unlock()
+}
@@ -0,0 +1,47 @@
+package handle
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wlibo666/filesync/lib/common"
+)
+
+func TestClientDryRun(t *testing.T) {
+	common.DryRun = true
+	defer func() { common.DryRun = false }()
+
+	beginDryRunWalk("10.0.0.5")
+	addDryRunPending("10.0.0.5", "/data/a.txt")
+	addDryRunPending("10.0.0.5", "/data/b.txt")
+	beginDryRunWalk("10.0.0.6")
+	endDryRunWalk("10.0.0.6")
+	// client without queued files is done after walk
+	clientDryRunLock.Lock()
+	_, ok := clientDryRuns["10.0.0.6"]
+	clientDryRunLock.Unlock()
+	if ok {
+		t.Fatalf("dry run of client without queued files is not done")
+	}
+	endDryRunWalk("10.0.0.5")
+
+	recordClientDryRun("10.0.0.5", "writeReq", 12)
+	recordClientDryRun("10.0.0.6", "writeReq", 100)
+	doneDryRunEvent("/data/a.txt")
+	clientDryRunLock.Lock()
+	dryRun, ok := clientDryRuns["10.0.0.5"]
+	clientDryRunLock.Unlock()
+	if !ok {
+		t.Fatalf("dry run of client is done before queued files are processed")
+	}
+	if summary := dryRun.stats.Summary(); !strings.Contains(summary, "writeReq:1(12 bytes)") {
+		t.Fatalf("summary of client is %s", summary)
+	}
+	doneDryRunEvent("/data/b.txt")
+	clientDryRunLock.Lock()
+	_, ok = clientDryRuns["10.0.0.5"]
+	clientDryRunLock.Unlock()
+	if ok {
+		t.Fatalf("dry run of client is not done after queued files are processed")
+	}
+}
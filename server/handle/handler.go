@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -22,31 +23,50 @@ import (
 var (
 	ERR_ONLY_SUPPORT_HEARTBEAT_MSG = errors.New("Only support heartbeat msg in this port")
 
-	eventChan    = make(chan fsnotify.Event, syncproto.SYNC_FILE_NUM_ONETIME)
 	moniDirNames = make(map[string]chan bool)
 	dirRwLock    = sync.RWMutex{}
 
+	// guarded by clientRwLock
 	ClientsAddr   = make(map[string]bool)
 	HeartBeatList = make(map[string]int64)
+	clientRwLock  = sync.RWMutex{}
+
+	clientInfos      = make(map[string]*ClientInfo)
+	clientInfoRwLock = sync.RWMutex{}
+
+	snapshotMarkers    = make(map[string]chan bool)
+	snapshotMarkerLock = sync.Mutex{}
 )
 
+// ClientInfo is what client told us in heartbeat
+type ClientInfo struct {
+	Version  uint32
+	HashAlgo string
+}
+
 func processHeartBeat(conn net.Conn) error {
-	maxTry := syncproto.MAX_RETRY_TIME
+	maxTry := config.GetServerConf().MaxRetry
 	tmpTry := 0
 	clientAddr := conn.RemoteAddr().String()
 	clientIp := strings.Split(clientAddr, ":")[0]
+	// set when client is single port
+	var session *clientSession
+	// client signs its token with nonce of conn sent in heartbeat response
+	nonce := common.NewNonce()
 	for {
 		if tmpTry >= maxTry {
+			clientRwLock.Lock()
 			ClientsAddr[strings.Split(clientAddr, ":")[0]] = false
+			clientRwLock.Unlock()
 			log.Logger.Warn("Lost client:%s.", clientAddr)
-			return fmt.Errorf("client:%s lost.")
+			return fmt.Errorf("client:%s lost.", clientAddr)
 		}
 		// read heartbeat request msg
 		msgData, err := common.ReadMsg(conn)
 		if err != nil {
 			log.Logger.Warn("ReadMsg from conn:%s failed,err:%s", clientAddr, err.Error())
 			tmpTry++
-			time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
+			time.Sleep(time.Duration(config.GetServerConf().HeartBeatInterval) * time.Second)
 			continue
 		}
 		msg := &syncproto.FileSyncProto{}
@@ -54,38 +74,71 @@ func processHeartBeat(conn net.Conn) error {
 		if err != nil {
 			log.Logger.Warn("proto.Unmarshal failed,err:%s", err.Error())
 			tmpTry++
-			time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
+			time.Sleep(time.Duration(config.GetServerConf().HeartBeatInterval) * time.Second)
 			continue
 		}
 		syncproto.LogMsg(conn, msg)
-		if msg.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_REQ {
+		// request conn only carry one request
+		if isRequestMsg(msg.GetMsgType()) {
+			atomic.AddInt32(&inflightRequests, 1)
+			defer atomic.AddInt32(&inflightRequests, -1)
+			return processRequest(conn, msg)
+		}
+		if session != nil && isRespMsg(msg.GetMsgType()) {
+			session.deliver(msg)
+			continue
+		}
+		if msg.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_REQ && msg.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ {
 			log.Logger.Warn("not heartbeat msg,resp msg is:%d,%s", msg.GetMsgType(), syncproto.GetMsgName(msg.GetMsgType()))
 			tmpTry++
-			time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
+			time.Sleep(time.Duration(config.GetServerConf().HeartBeatInterval) * time.Second)
 			continue
 		}
 
+		if msg.GetMsgType() == syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ && session == nil {
+			log.Logger.Info("client:%s is single port,push msgs on its heartbeat conn", clientAddr)
+			session = addSession(clientIp, conn)
+			defer removeSession(clientIp, session)
+		}
+
+		hashAlgo := common.NegotiateHashAlgo(config.GetServerConf().HashAlgo, msg.GetHashAlgo())
+		clientInfoRwLock.Lock()
+		clientInfos[clientIp] = &ClientInfo{
+			Version:  msg.GetVersion(),
+			HashAlgo: hashAlgo,
+		}
+		clientInfoRwLock.Unlock()
+		registerClient(clientIp, nonce, msg)
+
 		// write heartbeat response msg
 		msgRes := &syncproto.FileSyncProto{
 			Version:    proto.Uint32(syncproto.PROTO_VERSION),
 			MsgType:    proto.Uint32(syncproto.PROTO_MSG_HEART_BETA_RES),
 			ContentLen: proto.Uint32(0),
+			HashAlgo:   proto.String(hashAlgo),
+			Nonce:      proto.String(nonce),
 		}
 		msgData, err = proto.Marshal(msgRes)
 		if err != nil {
 			log.Logger.Warn("proto.Marshal heartbeat res msg failed,err:%s", err.Error())
 			tmpTry++
-			time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
+			time.Sleep(time.Duration(config.GetServerConf().HeartBeatInterval) * time.Second)
 			continue
 		}
-		err = common.WriteMsg(msgData, conn)
+		if session != nil {
+			err = session.writeHeartBeatRes(msgData)
+		} else {
+			err = common.WriteMsg(msgData, conn)
+		}
 		if err != nil {
 			log.Logger.Warn("WriteMsg failed,err:%s", err.Error())
 			tmpTry++
-			time.Sleep(time.Duration(syncproto.HEART_BEAT_INTERVAL) * time.Second)
+			time.Sleep(time.Duration(config.GetServerConf().HeartBeatInterval) * time.Second)
 			continue
 		}
+		clientRwLock.Lock()
 		HeartBeatList[clientIp] = time.Now().Unix()
+		clientRwLock.Unlock()
 		// sync file online
 		err = syncFileOnline(conn)
 		if err != nil {
@@ -98,22 +151,35 @@ func processHeartBeat(conn net.Conn) error {
 
 func StartHeartBeatListener() {
 	go func() {
-		common.StartListen(fmt.Sprintf(":%d", syncproto.HEART_BEAT_LISTENER_PORT), processHeartBeat)
+		common.StartListen(fmt.Sprintf(":%d", config.GetServerConf().HeartBeatPort), processHeartBeat)
 	}()
 }
 
+// newFileMsg return msg of filename with root name and relative path
+func newFileMsg(filename string, msgType uint32) (*syncproto.FileSyncProto, error) {
+	moni, relPath, err := getMoniDir(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &syncproto.FileSyncProto{
+		Version:  proto.Uint32(syncproto.PROTO_VERSION),
+		MsgType:  proto.Uint32(msgType),
+		RootName: proto.String(moni.GetName()),
+		RelPath:  proto.String(relPath),
+	}, nil
+}
+
 func fileExist(filename string) bool {
-	fileLen, md5, err := common.GetFileInfo(filename)
+	fi, err := os.Stat(filename)
 	if err != nil {
 		return false
 	}
-	msg := &syncproto.FileSyncProto{
-		Version:    proto.Uint32(syncproto.PROTO_VERSION),
-		MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_EXIST_REQ),
-		FileName:   proto.String(filename),
-		FileMd5:    proto.String(md5),
-		ContentLen: proto.Uint32(fileLen),
+	// file hash is filled by sendMsgToClients with hash algo of every client
+	msg, err := newFileMsg(filename, syncproto.PROTO_MSG_FILE_EXIST_REQ)
+	if err != nil {
+		return false
 	}
+	msg.ContentLen = proto.Uint32(uint32(fi.Size()))
 	err = sendMsgToClients(filename, msg)
 	if err != nil {
 		return false
@@ -121,32 +187,89 @@ func fileExist(filename string) bool {
 	return true
 }
 
+func getClientInfo(clientIp string) *ClientInfo {
+	clientInfoRwLock.RLock()
+	defer clientInfoRwLock.RUnlock()
+	info, ok := clientInfos[clientIp]
+	if !ok {
+		return &ClientInfo{Version: syncproto.PROTO_VERSION_V1, HashAlgo: common.HASH_ALGO_MD5}
+	}
+	return info
+}
+
+// clientMsg return a copy of msg for client,with file hash by hash algo of client
+// for write/exist msg,FileMd5 is also set for md5 so that old client can check it,
+// and absolute FileName is set for client of version 1
+func clientMsg(msg *syncproto.FileSyncProto, filename string, info *ClientInfo) (*syncproto.FileSyncProto, error) {
+	var fileHash string
+	var err error
+	switch msg.GetMsgType() {
+	case syncproto.PROTO_MSG_FILE_WRITE_REQ:
+		fileHash, err = common.GetDataHash(info.HashAlgo, msg.GetContent())
+	case syncproto.PROTO_MSG_FILE_EXIST_REQ:
+		_, fileHash, err = common.GHashCache.GetFileHash(info.HashAlgo, filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	newMsg := *msg
+	if fileHash != "" {
+		newMsg.HashAlgo = proto.String(info.HashAlgo)
+		newMsg.FileHash = proto.String(fileHash)
+		if info.HashAlgo == common.HASH_ALGO_MD5 {
+			newMsg.FileMd5 = proto.String(fileHash)
+		}
+	}
+	if info.Version <= syncproto.PROTO_VERSION_V1 {
+		newMsg.FileName = proto.String(filename)
+	}
+	return &newMsg, nil
+}
+
 func moniDirFunc(dirName string) {
 	go func(path string) {
 		log.Logger.Info("moni dir:%s", path)
-		newFileWatcher(path)
+		err := newFileWatcher(path)
+		if err != nil {
+			log.Logger.Error("newFileWatcher for %s failed,err:%s", path, err.Error())
+		}
 	}(dirName)
 }
 
 func syncFiles(conn net.Conn) error {
 	clientIp := strings.Split(conn.RemoteAddr().String(), ":")[0]
-	moniDir := ""
+	found := false
 	// 查找上一次同步时间,如果未同步过则全同步,如果距离上次同步间有部分文件未同步则部分同步
-	for _, dir := range config.GServerConf.MoniDirs {
-		for _, ip := range dir.WhiteList {
+	for _, dir := range config.GetServerConf().MoniDirs {
+		for _, ip := range getWhiteListAddrs(dir) {
 			tmpIp := strings.Split(ip, ":")[0]
 			if tmpIp == clientIp {
-				moniDir = dir.DirName
+				found = true
+				err := syncDir(dir.DirName, clientIp)
+				if err != nil {
+					recordFailure("syncDir", dir.DirName, clientIp, err)
+					log.Logger.Warn("sync dir:%s to client:%s failed,err:%s", dir.DirName, clientIp, err.Error())
+				}
 				break
 			}
 		}
 	}
-	if moniDir == "" {
+	if !found {
 		log.Logger.Debug("not found dir by ip:%s", clientIp)
-		return nil
 	}
+	return nil
+}
+
+func syncDir(moniDir, clientIp string) error {
 	log.Logger.Info("will sync dir:%s to client:%s", moniDir, clientIp)
+	// summary of dry run is logged after queued files are processed
+	beginDryRunWalk(clientIp)
+	defer endDryRunWalk(clientIp)
 	err := filepath.Walk(moniDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Logger.Warn("walk file:%s failed,err:%s", path, err.Error())
+			return nil
+		}
 		if path == moniDir {
 			return nil
 		}
@@ -156,7 +279,8 @@ func syncFiles(conn net.Conn) error {
 		} else {
 			// check file is exist or not
 			if !fileExist(path) {
-				eventChan <- fsnotify.Event{Name: path, Op: fsnotify.Write}
+				addDryRunPending(clientIp, path)
+				eventQueue.push(fsnotify.Event{Name: path, Op: fsnotify.Write}, EVENT_PRIORITY_RECONCILE, stopWorkers)
 			} else {
 				log.Logger.Debug("file:[%s] exist in client,not need send", path)
 			}
@@ -169,17 +293,19 @@ func syncFiles(conn net.Conn) error {
 
 func syncFileOnline(conn net.Conn) error {
 	clientIp := strings.Split(conn.RemoteAddr().String(), ":")[0]
-	valid := config.IsInWhiteList(clientIp)
+	valid := isInWhiteList(clientIp)
 	if !valid {
 		return fmt.Errorf("client:%s is not in white list", clientIp)
 	}
 
 	syncFlag := false
+	clientRwLock.Lock()
 	online, ok := ClientsAddr[clientIp]
 	if !ok || !online {
 		ClientsAddr[clientIp] = true
 		syncFlag = true
 	}
+	clientRwLock.Unlock()
 
 	if syncFlag {
 		go func(conn net.Conn) {
@@ -190,8 +316,14 @@ func syncFileOnline(conn net.Conn) error {
 	return nil
 }
 
-func sendMsgToClient(ipAddr string, msg *syncproto.FileSyncProto) error {
-
+// sendMsgToClient send msg of moni dir to client and wait its response,
+// content is sent in rate limits
+func sendMsgToClient(ipAddr string, moni *config.FileSyncMoniConf, msg *syncproto.FileSyncProto) error {
+	clientIp := strings.Split(ipAddr, ":")[0]
+	// single port client receive msgs on its heartbeat conn
+	if session := getSession(clientIp); session != nil {
+		return session.send(msg, moni)
+	}
 	msgData, err := proto.Marshal(msg)
 	if err != nil {
 		return err
@@ -201,7 +333,7 @@ func sendMsgToClient(ipAddr string, msg *syncproto.FileSyncProto) error {
 		return err
 	}
 	syncproto.LogMsg(conn, msg)
-	err = common.WriteMsg(msgData, conn)
+	err = common.WriteMsg(msgData, newThrottledConn(conn, clientIp, moni))
 	if err != nil {
 		return err
 	}
@@ -222,40 +354,94 @@ func sendMsgToClient(ipAddr string, msg *syncproto.FileSyncProto) error {
 }
 
 func sendMsgToClients(fileName string, msg *syncproto.FileSyncProto) error {
+	moni, _, err := getMoniDir(fileName)
+	if err != nil {
+		return err
+	}
+	return sendMsgToMoniClients(moni, fileName, msg)
+}
+
+// sendMsgToMoniClients send msg to online clients in white list of moni dir
+func sendMsgToMoniClients(moni *config.FileSyncMoniConf, fileName string, msg *syncproto.FileSyncProto) error {
+	var err, sendErr error
+	clientMsgs := make(map[string]*syncproto.FileSyncProto)
 	now := time.Now().Unix()
+	heartBeats := make(map[string]int64)
+	clientRwLock.RLock()
 	for clientAddr, t := range HeartBeatList {
-		if now-t > (syncproto.MAX_RETRY_TIME * syncproto.HEART_BEAT_INTERVAL) {
+		heartBeats[clientAddr] = t
+	}
+	clientRwLock.RUnlock()
+	whiteList := getWhiteListAddrs(moni)
+	for clientAddr, t := range heartBeats {
+		if now-t > config.GetServerConf().GetLostSeconds() {
 			log.Logger.Info("now:%d,preT:%d,client:%s lost,not need send msg", now, t, clientAddr)
 			// record lost file
 			continue
 		}
-		for _, moni := range config.GServerConf.MoniDirs {
-			// match moni dir
-			if strings.Contains(fileName, moni.DirName) {
-				for _, ipAddr := range moni.WhiteList {
-					// match ipaddr
-					if clientAddr == strings.Split(ipAddr, ":")[0] {
-						err := sendMsgToClient(ipAddr, msg)
-						if err != nil {
-							if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
-								log.Logger.Error("send msg to client:%s,msgType:%d,msgname:%s failed,err:%s", ipAddr, msg.GetMsgType(), syncproto.GetMsgName(msg.GetMsgType()), err.Error())
-							} else {
-								log.Logger.Debug("send msg to client:%s,msgType:%d,msgname:%s failed,err:%s", ipAddr, msg.GetMsgType(), syncproto.GetMsgName(msg.GetMsgType()), err.Error())
-							}
-							return err
-						}
-					}
+		for _, ipAddr := range whiteList {
+			// match ipaddr
+			if clientAddr != strings.Split(ipAddr, ":")[0] {
+				continue
+			}
+			// client without snapshot_dir does not take snapshot
+			if msg.GetMsgType() == syncproto.PROTO_MSG_SNAPSHOT_REQ && !clientHasCap(ipAddr, syncproto.CAP_SNAPSHOT) {
+				continue
+			}
+			// only exist msg which change nothing is sent in dry run
+			if common.DryRun && msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+				log.Logger.Info("dry-run: would send %s of root:%s,path:%s,len:%d to client:%s", syncproto.GetMsgName(msg.GetMsgType()),
+					msg.GetRootName(), msg.GetRelPath(), len(msg.GetContent()), ipAddr)
+				recordClientDryRun(clientAddr, syncproto.GetMsgName(msg.GetMsgType()), len(msg.GetContent()))
+				continue
+			}
+			info := getClientInfo(clientAddr)
+			msgKey := fmt.Sprintf("%s/%d", info.HashAlgo, info.Version)
+			tmpMsg, ok := clientMsgs[msgKey]
+			if !ok {
+				tmpMsg, err = clientMsg(msg, fileName, info)
+				if err != nil {
+					return err
 				}
+				clientMsgs[msgKey] = tmpMsg
+			}
+			if isRetryMsg(msg.GetMsgType()) {
+				wal.addClientOp(ipAddr, fileName, msg.GetMsgType())
+			}
+			start := time.Now()
+			err := sendMsgToClient(ipAddr, moni, tmpMsg)
+			observeMsgSent(tmpMsg, err)
+			if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+				syncproto.LogMsgJson("send", ipAddr, tmpMsg, start, err)
+			}
+			if err != nil {
+				if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ {
+					recordFailure(syncproto.GetMsgName(msg.GetMsgType()), fileName, ipAddr, err)
+					log.Logger.Error("send msg to client:%s,msgType:%d,msgname:%s failed,err:%s", ipAddr, msg.GetMsgType(), syncproto.GetMsgName(msg.GetMsgType()), err.Error())
+				} else {
+					log.Logger.Debug("send msg to client:%s,msgType:%d,msgname:%s failed,err:%s", ipAddr, msg.GetMsgType(), syncproto.GetMsgName(msg.GetMsgType()), err.Error())
+				}
+				// failed file op is retried,other clients still get it
+				if isRetryMsg(msg.GetMsgType()) {
+					addRetry(ipAddr, fileName, syncproto.GetMsgName(msg.GetMsgType()), err)
+					sendErr = err
+					continue
+				}
+				return err
+			}
+			if isRetryMsg(msg.GetMsgType()) {
+				removeRetry(ipAddr, fileName)
+				wal.ackClientFile(ipAddr, fileName)
 			}
 		}
 	}
-	return nil
+	return sendErr
 }
 
 func syncCmdPorcess(event fsnotify.Event) error {
-	msg := &syncproto.FileSyncProto{
-		Version:  proto.Uint32(syncproto.PROTO_VERSION),
-		FileName: proto.String(event.Name),
+	msg, err := newFileMsg(event.Name, 0)
+	if err != nil {
+		return err
 	}
 
 	if event.Op&fsnotify.Create == fsnotify.Create {
@@ -282,28 +468,14 @@ func syncCmdPorcess(event fsnotify.Event) error {
 		msg.ContentLen = proto.Uint32(uint32(len(fileData)))
 	} else if event.Op&fsnotify.Remove == fsnotify.Remove {
 		log.Logger.Info("process remove:%s", event.Name)
-		dirRwLock.RLock()
-		done, ok := moniDirNames[event.Name]
-		dirRwLock.RUnlock()
-		if ok {
-			dirRwLock.Lock()
-			done <- true
-			delete(moniDirNames, event.Name)
-			dirRwLock.Unlock()
+		if stopMoniDir(event.Name) {
 			log.Logger.Info("remove/delete moni dir:%s", event.Name)
 		}
 		msg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_REMOVE_REQ)
 		msg.ContentLen = proto.Uint32(0)
 	} else if event.Op&fsnotify.Rename == fsnotify.Rename {
 		log.Logger.Info("process rename :%s", event.Name)
-		dirRwLock.RLock()
-		done, ok := moniDirNames[event.Name]
-		dirRwLock.RUnlock()
-		if ok {
-			dirRwLock.Lock()
-			done <- true
-			delete(moniDirNames, event.Name)
-			dirRwLock.Unlock()
+		if stopMoniDir(event.Name) {
 			log.Logger.Info("rename/delete moni dir:%s", event.Name)
 		}
 		msg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_RENAME_REQ)
@@ -317,21 +489,100 @@ func syncCmdPorcess(event fsnotify.Event) error {
 		return fmt.Errorf("unsupport Op:%d, name:%s", event.Op, event.Name)
 	}
 
+	// failed sends are recorded and retried
 	sendMsgToClients(event.Name, msg)
 	return nil
 }
 
+// StartSnapshotMarkers ask clients to take snapshot of moni dirs which snapshot_interval is set,
+// it is called again when reload and only markers of changed dirs are restarted
+func StartSnapshotMarkers() {
+	markers := make(map[string]*config.FileSyncMoniConf)
+	for _, moni := range config.GetServerConf().MoniDirs {
+		if moni.SnapshotInterval > 0 {
+			markers[fmt.Sprintf("%s|%d", moni.DirName, moni.SnapshotInterval)] = moni
+		}
+	}
+	snapshotMarkerLock.Lock()
+	defer snapshotMarkerLock.Unlock()
+	for key, stop := range snapshotMarkers {
+		if _, ok := markers[key]; !ok {
+			close(stop)
+			delete(snapshotMarkers, key)
+		}
+	}
+	for key, moni := range markers {
+		if _, ok := snapshotMarkers[key]; ok {
+			continue
+		}
+		stop := make(chan bool)
+		snapshotMarkers[key] = stop
+		go runSnapshotMarker(moni.DirName, moni.SnapshotInterval, stop)
+	}
+}
+
+func runSnapshotMarker(dirName string, interval int, stop chan bool) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// white list may be changed by reload
+		var moni *config.FileSyncMoniConf
+		for _, tmpMoni := range config.GetServerConf().MoniDirs {
+			if tmpMoni.DirName == dirName {
+				moni = tmpMoni
+			}
+		}
+		if moni == nil {
+			continue
+		}
+		log.Logger.Info("ask clients to take snapshot of dir:%s", moni.DirName)
+		msg := &syncproto.FileSyncProto{
+			Version:    proto.Uint32(syncproto.PROTO_VERSION),
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_SNAPSHOT_REQ),
+			RootName:   proto.String(moni.GetName()),
+			ContentLen: proto.Uint32(0),
+		}
+		err := sendMsgToMoniClients(moni, moni.DirName, msg)
+		if err != nil {
+			log.Logger.Warn("send snapshot msg of dir:%s failed,err:%s", moni.DirName, err.Error())
+		}
+	}
+}
+
 func startSyncFile() {
 	wg := &sync.WaitGroup{}
-	for i := 0; i < syncproto.SYNC_FILE_NUM_ONETIME; i++ {
+	for i := 0; i < config.GetServerConf().SyncWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for event := range eventChan {
+			for {
+				select {
+				case <-stopWorkers:
+					return
+				default:
+				}
+				item, ok := eventQueue.popItem(stopWorkers)
+				if !ok {
+					return
+				}
+				event := item.event
+				beginEvent(event)
 				err := syncCmdPorcess(event)
 				if err != nil {
+					recordFailure(event.Op.String(), event.Name, "", err)
 					log.Logger.Error("syncCmdPorcess event,op:%d,file:%s failed,err:%s", event.Op, event.Name, err.Error())
 				}
+				// reconcile events are not in wal
+				if item.inWal {
+					wal.ackEvent(item.walId)
+				}
+				doneDryRunEvent(event.Name)
+				endEvent(event)
 			}
 		}()
 	}
@@ -348,9 +599,19 @@ func newFileWatcher(path string) error {
 	go func(baseDir string) {
 		for {
 			select {
-			case event := <-watcher.Events:
-				eventChan <- fsnotify.Event{Name: event.Name, Op: event.Op}
-			case err := <-watcher.Errors:
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				eventsTotal.WithLabelValues(event.Op.String()).Inc()
+				common.LogJson("info", "event", map[string]interface{}{"op": event.Op.String(), "path": event.Name})
+				common.GHashCache.Invalidate(event.Name)
+				walId := wal.addEvent(event)
+				eventQueue.pushWal(fsnotify.Event{Name: event.Name, Op: event.Op}, walId, getEventPriority(event.Name), stopWorkers)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
 				log.Logger.Error("watch [%s] error:%s", baseDir, err.Error())
 			}
 		}
@@ -360,35 +621,34 @@ func newFileWatcher(path string) error {
 	if err != nil {
 		return err
 	}
-	dirRwLock.RLock()
+	dirRwLock.Lock()
 	_, ok := moniDirNames[path]
-	dirRwLock.RUnlock()
-	if !ok {
-		dirRwLock.Lock()
-		moniDirNames[path] = done
+	if ok || IsShuttingDown() {
+		// already watched,or no new watch when shutdown
 		dirRwLock.Unlock()
+		return nil
 	}
+	moniDirNames[path] = done
+	dirRwLock.Unlock()
 	<-done
 	return nil
 }
 
+// MoniFilesAndSync watch moni dirs and send events to clients,it return after shutdown
 func MoniFilesAndSync() error {
 	go func() {
 		startSyncFile()
 	}()
+	go startRetry(stopWorkers)
+	if config.GetServerConf().PendingEvents != "" {
+		loadPendingEvents(config.GetServerConf().PendingEvents)
+	}
+	restoreWal()
 
-	wg := &sync.WaitGroup{}
-	for _, moniDir := range config.GServerConf.MoniDirs {
-		wg.Add(1)
-		go func(baseDir string) {
-			defer wg.Done()
-			log.Logger.Info("will monitor dir:%s...", baseDir)
-			err := newFileWatcher(baseDir)
-			if err != nil {
-				log.Logger.Error("newFileWatcher for %s failed,err:%s", baseDir, err.Error())
-			}
-		}(moniDir.DirName)
+	for _, moniDir := range config.GetServerConf().MoniDirs {
+		log.Logger.Info("will monitor dir:%s...", moniDir.DirName)
+		moniDirFunc(moniDir.DirName)
 	}
-	wg.Wait()
+	<-stopWorkers
 	return nil
 }
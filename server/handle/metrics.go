@@ -0,0 +1,103 @@
+package handle
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+var (
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_server_events_total",
+		Help: "File events received from watcher,by op.",
+	}, []string{"op"})
+	msgsSentTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_server_messages_sent_total",
+		Help: "Messages sent to clients successfully,by type.",
+	}, []string{"type"})
+	msgsFailedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_server_messages_failed_total",
+		Help: "Messages failed to send to clients,by type.",
+	}, []string{"type"})
+	sentBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "filesync_server_sent_bytes_total",
+		Help: "File content bytes sent to clients.",
+	})
+	clientSentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_server_client_sent_bytes_total",
+		Help: "File content bytes sent,by client.",
+	}, []string{"client"})
+	rateLimitBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "filesync_server_rate_limit_bytes",
+		Help: "Current rate limit in bytes per second,by scope.",
+	}, []string{"scope"})
+	throttleWaitSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "filesync_server_throttle_wait_seconds_total",
+		Help: "Seconds sends waited for rate limit,by scope.",
+	}, []string{"scope"})
+	queueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "filesync_server_queue_depth",
+		Help: "Events waiting in queue.",
+	}, func() float64 {
+		return float64(eventQueue.len())
+	})
+	pendingRetries = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "filesync_server_pending_retries",
+		Help: "Failed ops waiting retry.",
+	}, func() float64 {
+		return float64(len(getRetryOps()))
+	})
+	walPending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "filesync_server_wal_pending_records",
+		Help: "Events and client ops pending in wal.",
+	}, func() float64 {
+		return float64(wal.pendingLen())
+	})
+	onlineClients = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "filesync_server_online_clients",
+		Help: "Clients heartbeated recently.",
+	}, func() float64 {
+		return float64(countOnlineClients())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsTotal, msgsSentTotal, msgsFailedTotal, sentBytesTotal, clientSentBytes, rateLimitBytes,
+		throttleWaitSeconds, queueDepth, pendingRetries, walPending, onlineClients)
+}
+
+// isClientOnline return true if client is online and not lost
+func isClientOnline(clientIp string) bool {
+	clientRwLock.RLock()
+	defer clientRwLock.RUnlock()
+	return ClientsAddr[clientIp] && time.Now().Unix()-HeartBeatList[clientIp] <= config.GetServerConf().GetLostSeconds()
+}
+
+// countOnlineClients return number of clients which are online and not lost
+func countOnlineClients() int {
+	clientRwLock.RLock()
+	ips := make([]string, 0, len(ClientsAddr))
+	for ip := range ClientsAddr {
+		ips = append(ips, ip)
+	}
+	clientRwLock.RUnlock()
+	count := 0
+	for _, ip := range ips {
+		if isClientOnline(ip) {
+			count++
+		}
+	}
+	return count
+}
+
+func observeMsgSent(msg *syncproto.FileSyncProto, err error) {
+	msgName := syncproto.GetMsgName(msg.GetMsgType())
+	if err != nil {
+		msgsFailedTotal.WithLabelValues(msgName).Inc()
+		return
+	}
+	msgsSentTotal.WithLabelValues(msgName).Inc()
+	sentBytesTotal.Add(float64(len(msg.GetContent())))
+}
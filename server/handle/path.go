@@ -0,0 +1,51 @@
+package handle
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/wlibo666/filesync/lib/common"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// getMoniDir return the moni dir which filename is under and the slash
+// separated path of filename relative to it,the longest moni dir wins
+func getMoniDir(filename string) (*config.FileSyncMoniConf, string, error) {
+	var moniDir *config.FileSyncMoniConf
+	relPath := ""
+	for _, moni := range config.GetServerConf().MoniDirs {
+		tmpPath, err := filepath.Rel(moni.DirName, filename)
+		if err != nil || tmpPath == "." || tmpPath == ".." || strings.HasPrefix(tmpPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if moniDir == nil || len(moni.DirName) > len(moniDir.DirName) {
+			moniDir = moni
+			relPath = filepath.ToSlash(tmpPath)
+		}
+	}
+	if moniDir == nil {
+		return nil, "", fmt.Errorf("file:%s is not in any moni dir", filename)
+	}
+	return moniDir, relPath, nil
+}
+
+// getClientMoniDir return moni dir named rootName which client is in white list of
+func getClientMoniDir(clientIp, rootName string) (*config.FileSyncMoniConf, error) {
+	for _, moni := range config.GetServerConf().MoniDirs {
+		if moni.GetName() != rootName {
+			continue
+		}
+		for _, ipAddr := range getWhiteListAddrs(moni) {
+			if clientIp == strings.Split(ipAddr, ":")[0] {
+				return moni, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("client:%s is not in white list of root:%s", clientIp, rootName)
+}
+
+// getMoniFile return file of slash separated relPath under moni dir
+func getMoniFile(moni *config.FileSyncMoniConf, relPath string) (string, error) {
+	return common.JoinRelPath(moni.DirName, relPath)
+}
@@ -0,0 +1,61 @@
+package handle
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestGetMoniDir(t *testing.T) {
+	config.GetServerConf().MoniDirs = []*config.FileSyncMoniConf{
+		{DirName: filepath.FromSlash("/home/server/src")},
+		{DirName: filepath.FromSlash("/home/server/src2"), Name: "src2"},
+		{DirName: filepath.FromSlash("/home/server/src/sub/")},
+	}
+	cases := []struct {
+		filename string
+		root     string
+		relPath  string
+		ok       bool
+	}{
+		{"/home/server/src/a/b.go", "/home/server/src", "a/b.go", true},
+		{"/home/server/src2/a/b.go", "src2", "a/b.go", true},
+		{"/home/server/src/sub/b.go", "/home/server/src/sub", "b.go", true},
+		{"/home/server/src", "", "", false},
+		{"/home/server/srca/b.go", "", "", false},
+	}
+	for _, c := range cases {
+		moni, relPath, err := getMoniDir(filepath.FromSlash(c.filename))
+		if !c.ok {
+			if err == nil {
+				t.Fatalf("getMoniDir(%s) should failed", c.filename)
+			}
+			continue
+		}
+		if err != nil || moni.GetName() != c.root || relPath != c.relPath {
+			t.Fatalf("getMoniDir(%s) is %v,%s,err:%v,want %s,%s", c.filename, moni, relPath, err, c.root, c.relPath)
+		}
+	}
+}
+
+func TestGetMoniFile(t *testing.T) {
+	moni := &config.FileSyncMoniConf{DirName: filepath.FromSlash("/home/server/src")}
+	cases := map[string]bool{
+		"a/b.go":             true,
+		"../etc/passwd":      false,
+		"a/../../etc/passwd": false,
+		"..\\..\\etc\\x":     false,
+		"C:foo":              false,
+		"/etc/passwd":        false,
+	}
+	for relPath, ok := range cases {
+		filename, err := getMoniFile(moni, relPath)
+		if ok && (err != nil || filename != filepath.Join(moni.DirName, filepath.FromSlash(relPath))) {
+			t.Fatalf("getMoniFile(%s) is %s,err:%v", relPath, filename, err)
+		}
+		if !ok && err == nil {
+			t.Fatalf("getMoniFile(%s) is %s,want error", relPath, filename)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package handle
+
+import (
+	"container/heap"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// priorities of events,higher ones are taken first
+const (
+	// walk of dir when client connect
+	EVENT_PRIORITY_RECONCILE = 0
+	// live change of file larger than LARGE_FILE_SIZE
+	EVENT_PRIORITY_LARGE = 1
+	// live change
+	EVENT_PRIORITY_LIVE = 2
+	// live change matching high_priority patterns
+	EVENT_PRIORITY_HIGH = 3
+
+	LARGE_FILE_SIZE = 1024 * 1024
+	// reconcile events queued at most,walk of dir waits when it is full
+	MAX_RECONCILE_EVENTS = 1000
+)
+
+type queuedEvent struct {
+	event    fsnotify.Event
+	priority int
+	// id of wal record of event,acked when it is processed
+	walId uint64
+	inWal bool
+	// enqueue time minus priority_boost seconds per priority level,smallest first,
+	// so that an event never waits more than 3 boosts behind newer higher ones
+	order int64
+	seq   uint64
+}
+
+type eventHeap []*queuedEvent
+
+func (h eventHeap) Len() int { return len(h) }
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].order != h[j].order {
+		return h[i].order < h[j].order
+	}
+	return h[i].seq < h[j].seq
+}
+func (h eventHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queuedEvent))
+}
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// priorityQueue is queue of events sent by workers,
+// live events never block while reconcile events are limited
+type priorityQueue struct {
+	lock       sync.Mutex
+	items      eventHeap
+	seq        uint64
+	reconciles int
+	// signaled when event is pushed or reconcile event is taken
+	ready chan bool
+	space chan bool
+}
+
+var (
+	eventQueue = newPriorityQueue()
+)
+
+func newPriorityQueue() *priorityQueue {
+	return &priorityQueue{
+		items: make(eventHeap, 0),
+		ready: make(chan bool, 1),
+		space: make(chan bool, 1),
+	}
+}
+
+func signal(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
+
+// push queue event with priority,reconcile event waits while there are
+// MAX_RECONCILE_EVENTS of them,it is dropped if stop is closed
+func (q *priorityQueue) push(event fsnotify.Event, priority int, stop chan bool) {
+	q.pushItem(&queuedEvent{event: event, priority: priority}, stop)
+}
+
+// pushWal queue event recorded in wal as walId
+func (q *priorityQueue) pushWal(event fsnotify.Event, walId uint64, priority int, stop chan bool) {
+	q.pushItem(&queuedEvent{event: event, priority: priority, walId: walId, inWal: true}, stop)
+}
+
+func (q *priorityQueue) pushItem(item *queuedEvent, stop chan bool) {
+	priority := item.priority
+	for {
+		q.lock.Lock()
+		if priority != EVENT_PRIORITY_RECONCILE || q.reconciles < MAX_RECONCILE_EVENTS {
+			break
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.space:
+		case <-stop:
+			return
+		}
+	}
+	boost := int64(config.GetServerConf().PriorityBoost) * int64(time.Second)
+	q.seq++
+	item.order = time.Now().UnixNano() - int64(priority)*boost
+	item.seq = q.seq
+	heap.Push(&q.items, item)
+	if priority == EVENT_PRIORITY_RECONCILE {
+		q.reconciles++
+		if q.reconciles < MAX_RECONCILE_EVENTS {
+			signal(q.space)
+		}
+	}
+	q.lock.Unlock()
+	signal(q.ready)
+}
+
+func (q *priorityQueue) tryPop() (fsnotify.Event, bool) {
+	item, ok := q.tryPopItem()
+	if !ok {
+		return fsnotify.Event{}, false
+	}
+	return item.event, true
+}
+
+func (q *priorityQueue) tryPopItem() (*queuedEvent, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	item := heap.Pop(&q.items).(*queuedEvent)
+	if item.priority == EVENT_PRIORITY_RECONCILE {
+		q.reconciles--
+		signal(q.space)
+	}
+	if len(q.items) > 0 {
+		signal(q.ready)
+	}
+	return item, true
+}
+
+// pop wait and take event of highest priority,return false if stop is closed
+func (q *priorityQueue) pop(stop chan bool) (fsnotify.Event, bool) {
+	item, ok := q.popItem(stop)
+	if !ok {
+		return fsnotify.Event{}, false
+	}
+	return item.event, true
+}
+
+func (q *priorityQueue) popItem(stop chan bool) (*queuedEvent, bool) {
+	for {
+		if item, ok := q.tryPopItem(); ok {
+			return item, true
+		}
+		select {
+		case <-q.ready:
+		case <-stop:
+			return nil, false
+		}
+	}
+}
+
+func (q *priorityQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// depths return number of queued events by priority
+func (q *priorityQueue) depths() map[int]int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	depths := make(map[int]int)
+	for _, item := range q.items {
+		depths[item.priority]++
+	}
+	return depths
+}
+
+// drain take all queued events
+func (q *priorityQueue) drain() []fsnotify.Event {
+	events := make([]fsnotify.Event, 0)
+	for {
+		event, ok := q.tryPop()
+		if !ok {
+			return events
+		}
+		events = append(events, event)
+	}
+}
+
+// isHighPriority return true if relative path or base name of file matches high_priority
+func isHighPriority(relPath string) bool {
+	for _, pattern := range config.GetServerConf().HighPriority {
+		if ok, _ := path.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getEventPriority return priority of live change of filename
+func getEventPriority(filename string) int {
+	if _, relPath, err := getMoniDir(filename); err == nil && isHighPriority(relPath) {
+		return EVENT_PRIORITY_HIGH
+	}
+	if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() && fi.Size() > LARGE_FILE_SIZE {
+		return EVENT_PRIORITY_LARGE
+	}
+	return EVENT_PRIORITY_LIVE
+}
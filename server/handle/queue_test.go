@@ -0,0 +1,62 @@
+package handle
+
+import (
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	config.GetServerConf().PriorityBoost = config.DEFAULT_PRIORITY_BOOST
+	config.GetServerConf().HighPriority = []string{"*.conf", "etc/*"}
+	config.GetServerConf().MoniDirs = []*config.FileSyncMoniConf{{DirName: "/data/code"}}
+	defer func() {
+		config.GetServerConf().HighPriority = nil
+	}()
+	if getEventPriority("/data/code/nginx.conf") != EVENT_PRIORITY_HIGH || getEventPriority("/data/code/etc/hosts") != EVENT_PRIORITY_HIGH {
+		t.Fatalf("files matching high_priority should be high priority")
+	}
+	if getEventPriority("/data/code/a.txt") != EVENT_PRIORITY_LIVE {
+		t.Fatalf("other files should be live priority")
+	}
+
+	q := newPriorityQueue()
+	q.push(fsnotify.Event{Name: "reconcile1"}, EVENT_PRIORITY_RECONCILE, nil)
+	q.push(fsnotify.Event{Name: "reconcile2"}, EVENT_PRIORITY_RECONCILE, nil)
+	q.push(fsnotify.Event{Name: "large"}, EVENT_PRIORITY_LARGE, nil)
+	q.push(fsnotify.Event{Name: "live"}, EVENT_PRIORITY_LIVE, nil)
+	q.push(fsnotify.Event{Name: "high"}, EVENT_PRIORITY_HIGH, nil)
+	depths := q.depths()
+	if q.len() != 5 || depths[EVENT_PRIORITY_RECONCILE] != 2 {
+		t.Fatalf("queue len:%d,depths:%v", q.len(), depths)
+	}
+	expects := []string{"high", "live", "large", "reconcile1", "reconcile2"}
+	for _, expect := range expects {
+		event, ok := q.tryPop()
+		if !ok || event.Name != expect {
+			t.Fatalf("pop got:%s,expect:%s", event.Name, expect)
+		}
+	}
+
+	// reconcile event waiting longer than boosts is taken before new live events
+	q.push(fsnotify.Event{Name: "reconcile"}, EVENT_PRIORITY_RECONCILE, nil)
+	q.items[0].order -= 3 * int64(config.DEFAULT_PRIORITY_BOOST) * 1e9
+	q.push(fsnotify.Event{Name: "live"}, EVENT_PRIORITY_LIVE, nil)
+	if event, _ := q.tryPop(); event.Name != "reconcile" {
+		t.Fatalf("old reconcile event should not starve,got:%s", event.Name)
+	}
+
+	// reconcile push is dropped when queue is full and stop is closed
+	stop := make(chan bool)
+	close(stop)
+	for i := 0; i < MAX_RECONCILE_EVENTS+1; i++ {
+		q.push(fsnotify.Event{Name: "reconcile"}, EVENT_PRIORITY_RECONCILE, stop)
+	}
+	if q.len() != MAX_RECONCILE_EVENTS+1 || q.reconciles != MAX_RECONCILE_EVENTS {
+		t.Fatalf("reconcile events should be limited,len:%d,reconciles:%d", q.len(), q.reconciles)
+	}
+	if len(q.drain()) != MAX_RECONCILE_EVENTS+1 || q.len() != 0 {
+		t.Fatalf("drain should take all events")
+	}
+}
@@ -0,0 +1,236 @@
+package handle
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// ClientReg is what client announced in heartbeat handshake,it is shown by admin api.
+// listen address is empty for single port client
+type ClientReg struct {
+	Id         string   `json:"id"`
+	Ip         string   `json:"ip"`
+	ListenAddr string   `json:"listen_addr"`
+	Roots      []string `json:"roots"`
+	Caps       []string `json:"caps"`
+	Time       int64    `json:"time"`
+	// client proved client_secret of its id,only then its id matches white list
+	Authenticated bool `json:"authenticated"`
+}
+
+var (
+	// registered clients by identity
+	clientRegs    = make(map[string]*ClientReg)
+	clientRegLock = sync.RWMutex{}
+	// ips in white list skipped for having no port,warned once
+	noPortWarned = sync.Map{}
+)
+
+// wantRoot return true if client wants root,client which announced no roots wants all
+func (reg *ClientReg) wantRoot(root string) bool {
+	if len(reg.Roots) == 0 {
+		return true
+	}
+	for _, name := range reg.Roots {
+		if name == root {
+			return true
+		}
+	}
+	return false
+}
+
+func (reg *ClientReg) hasCap(capName string) bool {
+	for _, name := range reg.Caps {
+		if name == capName {
+			return true
+		}
+	}
+	return false
+}
+
+// getSendAddr return address msgs are sent to,ip of client for single port client
+func (reg *ClientReg) getSendAddr() string {
+	if reg.ListenAddr == "" {
+		return reg.Ip
+	}
+	return reg.ListenAddr
+}
+
+// getListenAddr return listen address announced by client,host is the ip
+// of client if it listens on all addresses
+func getListenAddr(clientIp, listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return ""
+	}
+	if host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+		host = clientIp
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isRegWhiteListed return true if ip of client is in white list of any moni dir,
+// or client is authenticated and its id is
+func isRegWhiteListed(reg *ClientReg) bool {
+	for _, moni := range config.GetServerConf().MoniDirs {
+		for _, entry := range moni.WhiteList {
+			host := entry
+			if tmpHost, _, err := net.SplitHostPort(entry); err == nil {
+				host = tmpHost
+			}
+			if host == reg.Ip || reg.Authenticated && entry == reg.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// registerClient keep registration of client announced in heartbeat msg,nothing is
+// done for old client without identity or client not in white list. token of client
+// is checked against nonce of its heartbeat conn,it is empty in first heartbeat of conn,
+// then authentication of registration at same address is kept.
+// client is set offline if it is new or its address changed,so that its dirs are synced
+// again by syncFileOnline. another client announcing the id of a live registration is
+// refused,unless it is authenticated and the live one is not
+func registerClient(clientIp, nonce string, msg *syncproto.FileSyncProto) {
+	if msg.GetClientId() == "" {
+		return
+	}
+	now := time.Now().Unix()
+	reg := &ClientReg{
+		Id:         msg.GetClientId(),
+		Ip:         clientIp,
+		ListenAddr: getListenAddr(clientIp, msg.GetListenAddr()),
+		Roots:      msg.GetRoots(),
+		Caps:       msg.GetCaps(),
+		Time:       now,
+	}
+	reg.Authenticated = common.CheckClientToken(config.GetServerConf().ClientSecrets[reg.Id], reg.Id, nonce, msg.GetToken())
+	clientRegLock.Lock()
+	old, ok := clientRegs[reg.Id]
+	moved := ok && (old.Ip != reg.Ip || old.ListenAddr != reg.ListenAddr)
+	live := ok && now-old.Time <= config.GetServerConf().GetLostSeconds()
+	if live && !moved && old.Authenticated && msg.GetToken() == "" {
+		reg.Authenticated = true
+	}
+	if !isRegWhiteListed(reg) {
+		clientRegLock.Unlock()
+		log.Logger.Debug("skip registration of client:%s from ip:%s,it is not in white list", reg.Id, reg.Ip)
+		return
+	}
+	if moved && live && (old.Authenticated || !reg.Authenticated) {
+		clientRegLock.Unlock()
+		log.Logger.Warn("refuse client:%s from ip:%s,listen:%s,it is registered by live ip:%s,listen:%s", reg.Id, reg.Ip, reg.ListenAddr, old.Ip, old.ListenAddr)
+		return
+	}
+	clientRegs[reg.Id] = reg
+	clientRegLock.Unlock()
+	if ok && !moved {
+		return
+	}
+	if ok {
+		log.Logger.Info("client:%s moved from ip:%s,listen:%s to ip:%s,listen:%s", reg.Id, old.Ip, old.ListenAddr, reg.Ip, reg.ListenAddr)
+	} else {
+		log.Logger.Info("client:%s registered,ip:%s,listen:%s,roots:%v,caps:%v,authenticated:%v", reg.Id, reg.Ip, reg.ListenAddr, reg.Roots, reg.Caps, reg.Authenticated)
+	}
+	clientRwLock.Lock()
+	ClientsAddr[clientIp] = false
+	clientRwLock.Unlock()
+}
+
+// getClientRegs return registered clients sorted by identity
+func getClientRegs() []*ClientReg {
+	clientRegLock.RLock()
+	regs := make([]*ClientReg, 0, len(clientRegs))
+	for _, reg := range clientRegs {
+		regs = append(regs, reg)
+	}
+	clientRegLock.RUnlock()
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].Id < regs[j].Id
+	})
+	return regs
+}
+
+// clientHasCap return true if client at ipAddr announced capName,
+// old client without registration is assumed to have it
+func clientHasCap(ipAddr, capName string) bool {
+	found := false
+	for _, reg := range getClientRegs() {
+		if reg.getSendAddr() != ipAddr && reg.Ip != ipAddr {
+			continue
+		}
+		if reg.hasCap(capName) {
+			return true
+		}
+		found = true
+	}
+	return !found
+}
+
+// getWhiteListAddrs return addresses of clients in white list of moni.
+// an entry is ip:port,ip or identity of client,ip and identity are resolved
+// by registrations,identity only by authenticated ones,and registered clients
+// which do not want the dir are skipped. ip of unregistered client is kept
+// only if it is single port,there is no port to send to otherwise
+func getWhiteListAddrs(moni *config.FileSyncMoniConf) []string {
+	addrs := make([]string, 0)
+	if moni == nil {
+		return addrs
+	}
+	found := make(map[string]bool)
+	add := func(addr string) {
+		if !found[addr] {
+			found[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	regs := getClientRegs()
+	for _, entry := range moni.WhiteList {
+		if _, _, err := net.SplitHostPort(entry); err == nil {
+			add(entry)
+			continue
+		}
+		isIp := net.ParseIP(entry) != nil
+		registered := false
+		for _, reg := range regs {
+			if isIp && reg.Ip != entry || !isIp && (reg.Id != entry || !reg.Authenticated) {
+				continue
+			}
+			registered = true
+			if reg.wantRoot(moni.GetName()) {
+				add(reg.getSendAddr())
+			}
+		}
+		if !isIp || registered {
+			continue
+		}
+		if getSession(entry) != nil {
+			add(entry)
+		} else if _, warned := noPortWarned.LoadOrStore(entry, true); !warned {
+			log.Logger.Warn("skip client:%s in white list of dir:%s,it is not registered and has no port", entry, moni.DirName)
+		}
+	}
+	return addrs
+}
+
+// isInWhiteList return true if client is in white list of any moni dir
+func isInWhiteList(clientIp string) bool {
+	for _, moni := range config.GetServerConf().MoniDirs {
+		for _, ipAddr := range getWhiteListAddrs(moni) {
+			if clientIp == strings.Split(ipAddr, ":")[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
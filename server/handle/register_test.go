@@ -0,0 +1,131 @@
+package handle
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestRegisterClient(t *testing.T) {
+	conf := config.GetServerConf()
+	moniDirs, secrets, maxRetry, interval := conf.MoniDirs, conf.ClientSecrets, conf.MaxRetry, conf.HeartBeatInterval
+	conf.MoniDirs = []*config.FileSyncMoniConf{
+		{Name: "code", DirName: "/data/code", WhiteList: []string{"web-01", "10.0.0.6", "10.0.0.8:9091"}},
+		{Name: "docs", DirName: "/data/docs", WhiteList: []string{"web-01", "db-01"}},
+	}
+	conf.ClientSecrets = map[string]string{"web-01": "secret1", "db-01": "secret2"}
+	conf.MaxRetry, conf.HeartBeatInterval = 3, 10
+	defer func() {
+		conf.MoniDirs, conf.ClientSecrets, conf.MaxRetry, conf.HeartBeatInterval = moniDirs, secrets, maxRetry, interval
+		clientRegLock.Lock()
+		clientRegs = make(map[string]*ClientReg)
+		clientRegLock.Unlock()
+		clientRwLock.Lock()
+		for _, ip := range []string{"10.0.0.5", "10.0.0.7", "10.0.0.9", "10.0.0.10", "10.0.0.11"} {
+			delete(ClientsAddr, ip)
+		}
+		clientRwLock.Unlock()
+	}()
+	// nonce of heartbeat conn of client
+	nonce := common.NewNonce()
+	token := func(id, secret string) *string {
+		return proto.String(common.NewClientToken(secret, id, nonce))
+	}
+
+	// old client without identity is not registered
+	registerClient("10.0.0.9", nonce, &syncproto.FileSyncProto{ListenAddr: proto.String(":9091")})
+	if len(getClientRegs()) != 0 {
+		t.Fatalf("client without identity should not be registered")
+	}
+	registerClient("10.0.0.5", nonce, &syncproto.FileSyncProto{
+		ClientId:   proto.String("web-01"),
+		ListenAddr: proto.String("0.0.0.0:9091"),
+		Roots:      []string{"code"},
+		Token:      token("web-01", "secret1"),
+	})
+	// client not in white list is not registered,identity without valid token
+	// or with token of another conn does not match white list
+	registerClient("10.0.0.11", nonce, &syncproto.FileSyncProto{
+		ClientId:   proto.String("db-01"),
+		ListenAddr: proto.String(":9091"),
+		Token:      token("db-01", "wrong"),
+	})
+	registerClient("10.0.0.12", common.NewNonce(), &syncproto.FileSyncProto{
+		ClientId:   proto.String("db-01"),
+		ListenAddr: proto.String(":9091"),
+		Token:      token("db-01", "secret2"),
+	})
+	if regs := getClientRegs(); len(regs) != 1 || regs[0].Id != "web-01" || !regs[0].Authenticated {
+		t.Fatalf("registrations are %v", regs)
+	}
+	// heartbeat without token on new conn keeps authentication of same address
+	registerClient("10.0.0.5", common.NewNonce(), &syncproto.FileSyncProto{
+		ClientId:   proto.String("web-01"),
+		ListenAddr: proto.String("0.0.0.0:9091"),
+		Roots:      []string{"code"},
+	})
+	code, docs := config.GetServerConf().MoniDirs[0], config.GetServerConf().MoniDirs[1]
+	// unregistered ip has no port unless it is single port
+	if addrs := getWhiteListAddrs(code); !reflect.DeepEqual(addrs, []string{"10.0.0.5:9091", "10.0.0.8:9091"}) {
+		t.Fatalf("white list of code is %v", addrs)
+	}
+	session := addSession("10.0.0.6", nil)
+	addrs := getWhiteListAddrs(code)
+	removeSession("10.0.0.6", session)
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.5:9091", "10.0.0.6", "10.0.0.8:9091"}) {
+		t.Fatalf("white list of code with single port client is %v", addrs)
+	}
+	// web-01 does not want docs and db-01 is not authenticated
+	if addrs := getWhiteListAddrs(docs); len(addrs) != 0 {
+		t.Fatalf("white list of docs is %v", addrs)
+	}
+	if !isInWhiteList("10.0.0.5") || isInWhiteList("10.0.0.7") {
+		t.Fatalf("isInWhiteList of registered client is wrong")
+	}
+	if clientHasCap("10.0.0.5:9091", syncproto.CAP_SNAPSHOT) || !clientHasCap("10.0.0.8:9091", syncproto.CAP_SNAPSHOT) {
+		t.Fatalf("clientHasCap of registered client is wrong")
+	}
+
+	// another client with the id of a live registration is refused
+	clientRwLock.Lock()
+	ClientsAddr["10.0.0.7"] = true
+	ClientsAddr["10.0.0.10"] = true
+	clientRwLock.Unlock()
+	for _, ip := range []string{"10.0.0.7", "10.0.0.10"} {
+		registerClient(ip, nonce, &syncproto.FileSyncProto{
+			ClientId:   proto.String("web-01"),
+			ListenAddr: proto.String(":9092"),
+			Token:      token("web-01", "secret1"),
+		})
+	}
+	clientRwLock.RLock()
+	online := ClientsAddr["10.0.0.10"]
+	clientRwLock.RUnlock()
+	if !isInWhiteList("10.0.0.5") || isInWhiteList("10.0.0.7") || !online {
+		t.Fatalf("registration of live client is replaced")
+	}
+
+	// client moved to another ip and port after the old registration is lost,it is synced again
+	clientRegLock.Lock()
+	clientRegs["web-01"].Time -= conf.GetLostSeconds() + 1
+	clientRegLock.Unlock()
+	registerClient("10.0.0.7", nonce, &syncproto.FileSyncProto{
+		ClientId:   proto.String("web-01"),
+		ListenAddr: proto.String(":9092"),
+		Caps:       []string{syncproto.CAP_SNAPSHOT},
+		Token:      token("web-01", "secret1"),
+	})
+	if addrs := getWhiteListAddrs(docs); !reflect.DeepEqual(addrs, []string{"10.0.0.7:9092"}) {
+		t.Fatalf("white list of docs after move is %v", addrs)
+	}
+	if !isInWhiteList("10.0.0.7") || isInWhiteList("10.0.0.5") || !clientHasCap("10.0.0.7:9092", syncproto.CAP_SNAPSHOT) {
+		t.Fatalf("registration is not updated after move")
+	}
+	if isClientOnline("10.0.0.7") {
+		t.Fatalf("moved client should be set offline to sync again")
+	}
+}
@@ -0,0 +1,102 @@
+package handle
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+var (
+	reloadLock = sync.Mutex{}
+)
+
+// watchMoniDir watch dir and all its sub dirs
+func watchMoniDir(dirName string) {
+	filepath.Walk(dirName, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Logger.Warn("walk file:%s failed,err:%s", path, err.Error())
+			return nil
+		}
+		if info.IsDir() {
+			moniDirFunc(path)
+		}
+		return nil
+	})
+}
+
+// stopMoniDirs stop watching dir and all its sub dirs
+func stopMoniDirs(dirName string) {
+	prefix := strings.TrimRight(dirName, string(filepath.Separator)) + string(filepath.Separator)
+	dirRwLock.Lock()
+	defer dirRwLock.Unlock()
+	for name, done := range moniDirNames {
+		if name == dirName || strings.HasPrefix(name, prefix) {
+			close(done)
+			delete(moniDirNames, name)
+		}
+	}
+}
+
+func getWhiteListIps(moni *config.FileSyncMoniConf) map[string]bool {
+	ips := make(map[string]bool)
+	for _, ipAddr := range getWhiteListAddrs(moni) {
+		ips[strings.Split(ipAddr, ":")[0]] = true
+	}
+	return ips
+}
+
+// Reload read config file again and apply it: watch added moni dirs, stop watching
+// removed ones and sync dirs to online clients newly in white list.
+// running config is kept if new one is invalid
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	newConf, err := config.ReloadConfig()
+	if err != nil {
+		log.Logger.Error("reload config:%s failed,keep running config,err:%s", config.ConfFileName, err.Error())
+		return err
+	}
+	oldDirs := make(map[string]*config.FileSyncMoniConf)
+	for _, moni := range config.GetServerConf().MoniDirs {
+		oldDirs[moni.DirName] = moni
+	}
+	newDirs := make(map[string]*config.FileSyncMoniConf)
+	for _, moni := range newConf.MoniDirs {
+		newDirs[moni.DirName] = moni
+	}
+	config.SetServerConf(newConf)
+
+	for dirName := range oldDirs {
+		if _, ok := newDirs[dirName]; !ok {
+			log.Logger.Info("reload,stop monitor dir:%s", dirName)
+			stopMoniDirs(dirName)
+		}
+	}
+	for dirName, moni := range newDirs {
+		oldMoni, ok := oldDirs[dirName]
+		if !ok {
+			log.Logger.Info("reload,will monitor dir:%s...", dirName)
+			watchMoniDir(dirName)
+		}
+		oldIps := getWhiteListIps(oldMoni)
+		for clientIp := range getWhiteListIps(moni) {
+			if oldIps[clientIp] || !isClientOnline(clientIp) {
+				continue
+			}
+			go func(dirName, clientIp string) {
+				err := syncDir(dirName, clientIp)
+				if err != nil {
+					recordFailure("syncDir", dirName, clientIp, err)
+					log.Logger.Warn("sync dir:%s to client:%s failed,err:%s", dirName, clientIp, err.Error())
+				}
+			}(dirName, clientIp)
+		}
+	}
+	StartSnapshotMarkers()
+	log.Logger.Info("reload config:%s ok", config.ConfFileName)
+	return nil
+}
@@ -0,0 +1,72 @@
+package handle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func waitWatches(want string) string {
+	watches := ""
+	for i := 0; i < 20; i++ {
+		watches = strings.Join(getWatches(), ",")
+		if watches == want {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return watches
+}
+
+func TestReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+	os.MkdirAll(filepath.Join(dirB, "c"), os.ModePerm)
+	os.MkdirAll(dirA, os.ModePerm)
+	confFile := filepath.Join(tmpDir, "server.json")
+	writeConf := func(conf string) {
+		ioutil.WriteFile(confFile, []byte(conf), 0644)
+	}
+	writeConf(fmt.Sprintf(`{"moni_dir":[{"dir":%q,"white_list":["192.168.1.104:9091"]}]}`, dirA))
+	err = config.LoadConfig(confFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed,err:%s", err.Error())
+	}
+	moniDirFunc(dirA)
+	if watches := waitWatches(dirA); watches != dirA {
+		t.Fatalf("watches is %s,want %s", watches, dirA)
+	}
+
+	writeConf(`{"hash_algo":"crc32","moni_dir":[]}`)
+	err = Reload()
+	if err == nil || len(config.GetServerConf().MoniDirs) != 1 {
+		t.Fatalf("invalid config should not be reloaded,err:%v", err)
+	}
+	writeConf(fmt.Sprintf(`{"moni_dir":[{"dir":%q,"white_list":["192.168.1.104:9091"]}]}`, dirA+"typo"))
+	err = Reload()
+	if err == nil || config.GetServerConf().MoniDirs[0].DirName != dirA {
+		t.Fatalf("config with missing moni dir should not be reloaded,err:%v", err)
+	}
+
+	writeConf(fmt.Sprintf(`{"moni_dir":[{"dir":%q,"white_list":["192.168.1.104:9091"]}]}`, dirB))
+	err = Reload()
+	if err != nil || len(config.GetServerConf().MoniDirs) != 1 || config.GetServerConf().MoniDirs[0].DirName != dirB {
+		t.Fatalf("reload failed,err:%v", err)
+	}
+	want := dirB + "," + filepath.Join(dirB, "c")
+	if watches := waitWatches(want); watches != want {
+		t.Fatalf("watches is %s,want %s", watches, want)
+	}
+	stopMoniDirs(dirB)
+}
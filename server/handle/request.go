@@ -0,0 +1,187 @@
+package handle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func isRequestMsg(msgType uint32) bool {
+	switch msgType {
+	case syncproto.PROTO_MSG_FILE_FETCH_REQ, syncproto.PROTO_MSG_FILE_LIST_REQ:
+		return true
+	}
+	return false
+}
+
+// processRequest process request from client and write response
+func processRequest(conn net.Conn, msg *syncproto.FileSyncProto) error {
+	clientIp := strings.Split(conn.RemoteAddr().String(), ":")[0]
+	var respMsg *syncproto.FileSyncProto
+	var err error
+	switch msg.GetMsgType() {
+	case syncproto.PROTO_MSG_FILE_FETCH_REQ:
+		respMsg, err = processFetch(clientIp, msg)
+	case syncproto.PROTO_MSG_FILE_LIST_REQ:
+		respMsg, err = processList(clientIp, msg)
+	default:
+		err = fmt.Errorf("unsupport request msgtype:%d", msg.GetMsgType())
+	}
+	if err != nil {
+		log.Logger.Warn("process %s from client:%s failed,err:%s", syncproto.GetMsgName(msg.GetMsgType()), clientIp, err.Error())
+		recordFailure(syncproto.GetMsgName(msg.GetMsgType()), msg.GetRelPath(), clientIp, err)
+		respMsg = &syncproto.FileSyncProto{
+			Version:    proto.Uint32(syncproto.PROTO_VERSION),
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_COMMON_RESP_FAIL),
+			ContentLen: proto.Uint32(0),
+		}
+	}
+	respData, err := proto.Marshal(respMsg)
+	if err != nil {
+		return err
+	}
+	// responses carry content of moni dir like pushed msgs
+	moni, _ := getClientMoniDir(clientIp, msg.GetRootName())
+	return common.WriteMsg(respData, newThrottledConn(conn, clientIp, moni))
+}
+
+// processFetch response current state of file as the msg which would be sent
+// to sync it: write for file, create for dir and remove for not exist file
+func processFetch(clientIp string, msg *syncproto.FileSyncProto) (*syncproto.FileSyncProto, error) {
+	moni, err := getClientMoniDir(clientIp, msg.GetRootName())
+	if err != nil {
+		return nil, err
+	}
+	filename, err := getMoniFile(moni, msg.GetRelPath())
+	if err != nil {
+		return nil, err
+	}
+	respMsg, err := newFileMsg(filename, syncproto.PROTO_MSG_FILE_REMOVE_REQ)
+	if err != nil {
+		return nil, err
+	}
+	respMsg.ContentLen = proto.Uint32(0)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return respMsg, nil
+		}
+		return nil, err
+	}
+	if fi.IsDir() {
+		respMsg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_CREATE_REQ)
+		respMsg.ContentLen = proto.Uint32(syncproto.PROTO_DIR_LEN)
+		return respMsg, nil
+	}
+	fileData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	respMsg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ)
+	respMsg.Content = fileData
+	respMsg.ContentLen = proto.Uint32(uint32(len(fileData)))
+	return clientMsg(respMsg, filename, getClientInfo(clientIp))
+}
+
+// LIST_PAGE_SIZE is max entries in one list response
+const LIST_PAGE_SIZE = 1000
+
+// errListPageFull stop walk of list
+var errListPageFull = fmt.Errorf("list page is full")
+
+// isListed return true if slash separated path a is walked before or is b,
+// filepath.Walk visits names of a dir in lexical order and a dir before its files
+func isListed(a, b string) bool {
+	partsA, partsB := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(partsA) && i < len(partsB); i++ {
+		if partsA[i] != partsB[i] {
+			return partsA[i] < partsB[i]
+		}
+	}
+	return len(partsA) <= len(partsB)
+}
+
+// listRoot return at most size entries of moni dir walked after cursor,and cursor
+// of next page which is empty at the end. files failed to walk or hash are skipped
+func listRoot(moni *config.FileSyncMoniConf, hashAlgo, cursor string, size int) ([]*syncproto.ListEntry, string) {
+	entries := make([]*syncproto.ListEntry, 0)
+	next := ""
+	filepath.Walk(moni.DirName, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Logger.Warn("list file:%s failed,err:%s", path, err.Error())
+			return nil
+		}
+		if path == moni.DirName {
+			return nil
+		}
+		relPath, err := filepath.Rel(moni.DirName, path)
+		if err != nil {
+			return nil
+		}
+		entry := &syncproto.ListEntry{
+			Path: filepath.ToSlash(relPath),
+		}
+		if cursor != "" && isListed(entry.Path, cursor) {
+			// files of dir are all listed
+			if info.IsDir() && entry.Path != cursor && !strings.HasPrefix(cursor, entry.Path+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(entries) == size {
+			next = entries[len(entries)-1].Path
+			return errListPageFull
+		}
+		if info.IsDir() {
+			entry.Dir = true
+		} else {
+			fileLen, fileHash, err := common.GHashCache.GetFileHash(hashAlgo, path)
+			if err != nil {
+				log.Logger.Warn("list file:%s failed,err:%s", path, err.Error())
+				return nil
+			}
+			entry.Len = int64(fileLen)
+			entry.Hash = fileHash
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, next
+}
+
+// processList response one page of files of root with hash negotiated by HashAlgo of msg,
+// the page starts after RelPath of msg and RelPath of response is cursor of next page,
+// which is empty for the last one. content is json array of syncproto.ListEntry.
+// unlike syncDir which pushes changed files to an online client,it lets a client which
+// is not running as daemon pull the state of root and get a result per file
+func processList(clientIp string, msg *syncproto.FileSyncProto) (*syncproto.FileSyncProto, error) {
+	moni, err := getClientMoniDir(clientIp, msg.GetRootName())
+	if err != nil {
+		return nil, err
+	}
+	hashAlgo := common.NegotiateHashAlgo(config.GetServerConf().HashAlgo, msg.GetHashAlgo())
+	entries, next := listRoot(moni, hashAlgo, msg.GetRelPath(), LIST_PAGE_SIZE)
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return &syncproto.FileSyncProto{
+		Version:    proto.Uint32(syncproto.PROTO_VERSION),
+		MsgType:    proto.Uint32(syncproto.PROTO_MSG_COMMON_RESP_OK),
+		RootName:   proto.String(moni.GetName()),
+		RelPath:    proto.String(next),
+		HashAlgo:   proto.String(hashAlgo),
+		ContentLen: proto.Uint32(uint32(len(data))),
+		Content:    data,
+	}, nil
+}
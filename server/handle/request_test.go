@@ -0,0 +1,119 @@
+package handle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestProcessFetch(t *testing.T) {
+	moniDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(moniDir)
+	os.MkdirAll(filepath.Join(moniDir, "a"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(moniDir, "a", "b.txt"), []byte("hello world."), 0644)
+	config.GetServerConf().MoniDirs = []*config.FileSyncMoniConf{
+		{Name: "code", DirName: moniDir, WhiteList: []string{"192.168.1.104:9091"}},
+	}
+
+	cases := []struct {
+		clientIp string
+		relPath  string
+		msgType  uint32
+		ok       bool
+	}{
+		{"192.168.1.104", "a/b.txt", syncproto.PROTO_MSG_FILE_WRITE_REQ, true},
+		{"192.168.1.104", "a", syncproto.PROTO_MSG_FILE_CREATE_REQ, true},
+		{"192.168.1.104", "a/c.txt", syncproto.PROTO_MSG_FILE_REMOVE_REQ, true},
+		{"192.168.1.104", "../b.txt", 0, false},
+		{"192.168.1.105", "a/b.txt", 0, false},
+	}
+	for _, c := range cases {
+		msg := &syncproto.FileSyncProto{
+			MsgType:  proto.Uint32(syncproto.PROTO_MSG_FILE_FETCH_REQ),
+			RootName: proto.String("code"),
+			RelPath:  proto.String(c.relPath),
+		}
+		respMsg, err := processFetch(c.clientIp, msg)
+		if !c.ok {
+			if err == nil {
+				t.Fatalf("processFetch(%s,%s) should failed", c.clientIp, c.relPath)
+			}
+			continue
+		}
+		if err != nil || respMsg.GetMsgType() != c.msgType || respMsg.GetRelPath() != c.relPath {
+			t.Fatalf("processFetch(%s,%s) is %v,err:%v,want msgType:%d", c.clientIp, c.relPath, respMsg, err, c.msgType)
+		}
+	}
+}
+
+func TestProcessList(t *testing.T) {
+	moniDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(moniDir)
+	os.MkdirAll(filepath.Join(moniDir, "a"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(moniDir, "a", "b.txt"), []byte("hello world."), 0644)
+	config.GetServerConf().MoniDirs = []*config.FileSyncMoniConf{
+		{Name: "code", DirName: moniDir, WhiteList: []string{"192.168.1.104:9091"}},
+	}
+
+	msg := &syncproto.FileSyncProto{
+		MsgType:  proto.Uint32(syncproto.PROTO_MSG_FILE_LIST_REQ),
+		RootName: proto.String("code"),
+		HashAlgo: proto.String("sha256,md5"),
+	}
+	_, err = processList("192.168.1.105", msg)
+	if err == nil {
+		t.Fatalf("processList of client not in white list should failed")
+	}
+	respMsg, err := processList("192.168.1.104", msg)
+	if err != nil {
+		t.Fatalf("processList failed,err:%s", err.Error())
+	}
+	entries := make([]*syncproto.ListEntry, 0)
+	err = json.Unmarshal(respMsg.GetContent(), &entries)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("list content is %s,err:%v", respMsg.GetContent(), err)
+	}
+	fileHash, _ := common.GetDataHash(respMsg.GetHashAlgo(), []byte("hello world."))
+	if !entries[0].Dir || entries[0].Path != "a" || entries[1].Path != "a/b.txt" || entries[1].Len != 12 || entries[1].Hash != fileHash {
+		t.Fatalf("list content is %s", respMsg.GetContent())
+	}
+	if respMsg.GetRelPath() != "" {
+		t.Fatalf("cursor of last page is %s", respMsg.GetRelPath())
+	}
+
+	// pages follow cursor,unreadable files are skipped
+	for _, name := range []string{"a.txt", "c/d.txt", "c/e.txt", "f.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(moniDir, name)), os.ModePerm)
+		ioutil.WriteFile(filepath.Join(moniDir, name), []byte(name), 0644)
+	}
+	paths := make([]string, 0)
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		page, next := listRoot(config.GetServerConf().MoniDirs[0], common.HASH_ALGO_MD5, cursor, 2)
+		for _, entry := range page {
+			paths = append(paths, entry.Path)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	want := []string{"a", "a/b.txt", "a.txt", "c", "c/d.txt", "c/e.txt", "f.txt"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("listed paths are %v,want %v", paths, want)
+	}
+}
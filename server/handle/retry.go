@@ -0,0 +1,209 @@
+package handle
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+const (
+	// seconds of backoff before first retry,doubled after every failure
+	RETRY_MIN_BACKOFF = 1
+	RETRY_MAX_BACKOFF = 300
+	// seconds between checks of retries due
+	RETRY_CHECK_INTERVAL = 1
+)
+
+// RetryOp is failed operation of file to client,it is shown as pending by admin api.
+// only latest state of file is sent when retry,so one op is kept per client and file
+type RetryOp struct {
+	Client   string `json:"client"`
+	File     string `json:"file"`
+	Op       string `json:"op"`
+	Attempts int    `json:"attempts"`
+	NextTime int64  `json:"next_time"`
+	Err      string `json:"err"`
+}
+
+var (
+	retryOps  = make(map[string]*RetryOp)
+	retryLock = sync.Mutex{}
+)
+
+func getRetryKey(ipAddr, filename string) string {
+	return ipAddr + "|" + filename
+}
+
+func isRetryMsg(msgType uint32) bool {
+	switch msgType {
+	case syncproto.PROTO_MSG_FILE_CREATE_REQ, syncproto.PROTO_MSG_FILE_WRITE_REQ, syncproto.PROTO_MSG_FILE_REMOVE_REQ,
+		syncproto.PROTO_MSG_FILE_RENAME_REQ, syncproto.PROTO_MSG_FILE_CHMOD_REQ:
+		return true
+	}
+	return false
+}
+
+// getBackoff return seconds to wait before retry after attempts failures,
+// exponential with jitter in [backoff/2, backoff]
+func getBackoff(attempts int) int64 {
+	backoff := int64(RETRY_MIN_BACKOFF)
+	for i := 1; i < attempts && backoff < RETRY_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > RETRY_MAX_BACKOFF {
+		backoff = RETRY_MAX_BACKOFF
+	}
+	half := backoff / 2
+	return backoff - half + rand.Int63n(half+1)
+}
+
+// addRetry queue failed op of file to client,backoff grows if it is already queued
+func addRetry(ipAddr, filename, opName string, err error) {
+	retryLock.Lock()
+	defer retryLock.Unlock()
+	key := getRetryKey(ipAddr, filename)
+	op, ok := retryOps[key]
+	if !ok {
+		op = &RetryOp{Client: ipAddr, File: filename}
+		retryOps[key] = op
+	}
+	op.Op = opName
+	op.Attempts++
+	op.NextTime = time.Now().Unix() + getBackoff(op.Attempts)
+	op.Err = err.Error()
+}
+
+// removeRetry drop queued op of file to client,eg. latest state is sent
+func removeRetry(ipAddr, filename string) {
+	retryLock.Lock()
+	delete(retryOps, getRetryKey(ipAddr, filename))
+	retryLock.Unlock()
+}
+
+// getRetryOps return queued ops sorted by client and file
+func getRetryOps() []*RetryOp {
+	retryLock.Lock()
+	ops := make([]*RetryOp, 0, len(retryOps))
+	for _, op := range retryOps {
+		tmpOp := *op
+		ops = append(ops, &tmpOp)
+	}
+	retryLock.Unlock()
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Client != ops[j].Client {
+			return ops[i].Client < ops[j].Client
+		}
+		return ops[i].File < ops[j].File
+	})
+	return ops
+}
+
+// countRetries return number of queued ops by client ip
+func countRetries() map[string]int {
+	retryLock.Lock()
+	defer retryLock.Unlock()
+	counts := make(map[string]int)
+	for _, op := range retryOps {
+		counts[strings.Split(op.Client, ":")[0]]++
+	}
+	return counts
+}
+
+// newStateMsg return msg which makes file on client same as it is now:
+// create for dir, write for file and remove if it does not exist
+func newStateMsg(filename string) (*syncproto.FileSyncProto, error) {
+	msg, err := newFileMsg(filename, syncproto.PROTO_MSG_FILE_REMOVE_REQ)
+	if err != nil {
+		return nil, err
+	}
+	msg.ContentLen = proto.Uint32(0)
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return msg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		msg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_CREATE_REQ)
+		msg.ContentLen = proto.Uint32(syncproto.PROTO_DIR_LEN)
+		return msg, nil
+	}
+	fileData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	msg.MsgType = proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ)
+	msg.Content = fileData
+	msg.ContentLen = proto.Uint32(uint32(len(fileData)))
+	return msg, nil
+}
+
+// retryOp send latest state of file to client,nothing is sent if file is not
+// in moni dirs or client address is not in white list of it any more,
+// eg. client changed its port and dir is synced again to new address
+func retryOp(op *RetryOp) error {
+	clientIp := strings.Split(op.Client, ":")[0]
+	moni, _, err := getMoniDir(op.File)
+	if err != nil {
+		return nil
+	}
+	allowed := false
+	for _, ipAddr := range getWhiteListAddrs(moni) {
+		if ipAddr == op.Client {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil
+	}
+	msg, err := newStateMsg(op.File)
+	if err != nil {
+		return err
+	}
+	tmpMsg, err := clientMsg(msg, op.File, getClientInfo(clientIp))
+	if err != nil {
+		return err
+	}
+	err = sendMsgToClient(op.Client, moni, tmpMsg)
+	observeMsgSent(tmpMsg, err)
+	return err
+}
+
+// processRetries retry ops due at now of online clients
+func processRetries(now int64) {
+	for _, op := range getRetryOps() {
+		if op.NextTime > now || !isClientOnline(strings.Split(op.Client, ":")[0]) {
+			continue
+		}
+		err := retryOp(op)
+		if err != nil {
+			log.Logger.Warn("retry %s of file:%s to client:%s failed,attempts:%d,err:%s", op.Op, op.File, op.Client, op.Attempts, err.Error())
+			addRetry(op.Client, op.File, op.Op, err)
+			continue
+		}
+		log.Logger.Info("retry %s of file:%s to client:%s ok,attempts:%d", op.Op, op.File, op.Client, op.Attempts)
+		removeRetry(op.Client, op.File)
+		wal.ackClientFile(op.Client, op.File)
+	}
+}
+
+// startRetry retry failed ops until stop is closed
+func startRetry(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(RETRY_CHECK_INTERVAL * time.Second):
+		}
+		processRetries(time.Now().Unix())
+	}
+}
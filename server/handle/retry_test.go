@@ -0,0 +1,100 @@
+package handle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestRetry(t *testing.T) {
+	for attempts := 1; attempts < 20; attempts++ {
+		backoff := getBackoff(attempts)
+		if backoff < RETRY_MIN_BACKOFF || backoff > RETRY_MAX_BACKOFF {
+			t.Fatalf("backoff of %d attempts is %d", attempts, backoff)
+		}
+	}
+
+	moniDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(moniDir)
+	fileName := filepath.Join(moniDir, "a.txt")
+	ioutil.WriteFile(fileName, []byte("hello world."), 0644)
+
+	// fake client answer every msg with ok
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed,err:%s", err.Error())
+	}
+	defer listener.Close()
+	msgs := make(chan *syncproto.FileSyncProto, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			msgs <- readTestMsg(t, conn)
+			writeTestMsg(t, conn, syncproto.PROTO_MSG_COMMON_RESP_OK)
+			conn.Close()
+		}
+	}()
+	clientAddr := listener.Addr().String()
+	config.GetServerConf().MoniDirs = []*config.FileSyncMoniConf{{Name: "code", DirName: moniDir, WhiteList: []string{clientAddr}}}
+	maxRetry, interval := config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval
+	config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval = 30, 10
+	clientRwLock.Lock()
+	ClientsAddr["127.0.0.1"] = true
+	HeartBeatList["127.0.0.1"] = time.Now().Unix()
+	clientRwLock.Unlock()
+	defer func() {
+		config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval = maxRetry, interval
+		clientRwLock.Lock()
+		delete(ClientsAddr, "127.0.0.1")
+		delete(HeartBeatList, "127.0.0.1")
+		clientRwLock.Unlock()
+	}()
+
+	// failures of same file are kept as one op
+	addRetry(clientAddr, fileName, "createReq", fmt.Errorf("failed"))
+	addRetry(clientAddr, fileName, "writeReq", fmt.Errorf("failed"))
+	ops := getRetryOps()
+	if len(ops) != 1 || ops[0].Attempts != 2 || ops[0].Op != "writeReq" || countRetries()["127.0.0.1"] != 1 {
+		t.Fatalf("retry ops are %+v", ops)
+	}
+
+	// latest state of file is sent when retry
+	cases := []struct {
+		remove  bool
+		msgType uint32
+	}{
+		{false, syncproto.PROTO_MSG_FILE_WRITE_REQ},
+		{true, syncproto.PROTO_MSG_FILE_REMOVE_REQ},
+	}
+	for _, c := range cases {
+		if c.remove {
+			os.Remove(fileName)
+			addRetry(clientAddr, fileName, "writeReq", fmt.Errorf("failed"))
+		}
+		processRetries(time.Now().Unix() + RETRY_MAX_BACKOFF)
+		select {
+		case msg := <-msgs:
+			if msg.GetMsgType() != c.msgType || msg.GetRelPath() != "a.txt" {
+				t.Fatalf("retry msg is %s of %s", syncproto.GetMsgName(msg.GetMsgType()), msg.GetRelPath())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("retry msg is not sent")
+		}
+		if len(getRetryOps()) != 0 {
+			t.Fatalf("retry op should be removed after sent")
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package handle
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// clientSession is heartbeat conn of single port client,msgs are pushed to client
+// on it and responses are read by processHeartBeat,which is the only reader of conn
+type clientSession struct {
+	conn     net.Conn
+	clientIp string
+	// guard writes of heartbeat responses and pushed msgs
+	writeLock sync.Mutex
+	// heartbeat response waiting msg being pushed,written right after it
+	resLock    sync.Mutex
+	pendingRes []byte
+	// only one pushed msg wait response at a time
+	sendLock sync.Mutex
+	// seq of msg waiting response,client echoes it in response
+	seq    uint32
+	resps  chan *syncproto.FileSyncProto
+	closed chan bool
+}
+
+var (
+	// single port clients,keyed by ip
+	sessions    = make(map[string]*clientSession)
+	sessionLock = sync.RWMutex{}
+)
+
+// addSession register conn as session of client,replace old one
+func addSession(clientIp string, conn net.Conn) *clientSession {
+	session := &clientSession{
+		conn:     conn,
+		clientIp: clientIp,
+		resps:    make(chan *syncproto.FileSyncProto, 1),
+		closed:   make(chan bool),
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if old, ok := sessions[clientIp]; ok {
+		close(old.closed)
+	}
+	sessions[clientIp] = session
+	return session
+}
+
+// removeSession unregister session of client if it is not replaced
+func removeSession(clientIp string, session *clientSession) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	if sessions[clientIp] != session {
+		return
+	}
+	close(session.closed)
+	delete(sessions, clientIp)
+}
+
+// getSession return session of client,nil if client is not single port
+func getSession(clientIp string) *clientSession {
+	sessionLock.RLock()
+	defer sessionLock.RUnlock()
+	return sessions[clientIp]
+}
+
+func isRespMsg(msgType uint32) bool {
+	return msgType == syncproto.PROTO_MSG_COMMON_RESP_OK || msgType == syncproto.PROTO_MSG_COMMON_RESP_FAIL
+}
+
+// writeHeartBeatRes write heartbeat response without waiting msg being pushed,
+// which may be throttled for long,the response is written right after it then
+func (s *clientSession) writeHeartBeatRes(msgData []byte) error {
+	s.resLock.Lock()
+	s.pendingRes = msgData
+	s.resLock.Unlock()
+	if !s.writeLock.TryLock() {
+		return nil
+	}
+	err := s.flushRes()
+	s.unlockWrite()
+	return err
+}
+
+// writeTo write msg to conn which is s.conn or wraps it
+func (s *clientSession) writeTo(conn net.Conn, msgData []byte) error {
+	s.writeLock.Lock()
+	err := common.WriteMsg(msgData, conn)
+	if err == nil {
+		err = s.flushRes()
+	}
+	s.unlockWrite()
+	return err
+}
+
+// flushRes write pending heartbeat response,writeLock must be held
+func (s *clientSession) flushRes() error {
+	s.resLock.Lock()
+	msgData := s.pendingRes
+	s.pendingRes = nil
+	s.resLock.Unlock()
+	if msgData == nil {
+		return nil
+	}
+	return common.WriteMsg(msgData, s.conn)
+}
+
+// unlockWrite release writeLock,response set while it was held is written
+// unless another writer holds writeLock now,which writes it instead
+func (s *clientSession) unlockWrite() {
+	s.writeLock.Unlock()
+	for {
+		s.resLock.Lock()
+		pending := s.pendingRes != nil
+		s.resLock.Unlock()
+		if !pending || !s.writeLock.TryLock() {
+			return
+		}
+		err := s.flushRes()
+		s.writeLock.Unlock()
+		if err != nil {
+			log.Logger.Warn("write heartbeat response to conn:%s failed,err:%s", s.conn.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+}
+
+// deliver pass response read from conn to msg waiting it,response of other msg is dropped
+func (s *clientSession) deliver(resp *syncproto.FileSyncProto) {
+	if resp.GetSeq() != atomic.LoadUint32(&s.seq) {
+		log.Logger.Warn("drop response seq:%d from conn:%s,wait seq:%d", resp.GetSeq(), s.conn.RemoteAddr().String(), atomic.LoadUint32(&s.seq))
+		return
+	}
+	select {
+	case s.resps <- resp:
+	default:
+	}
+}
+
+// send push msg of moni dir to client in rate limits and wait its response
+func (s *clientSession) send(msg *syncproto.FileSyncProto, moni *config.FileSyncMoniConf) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	// msg may be sent to other clients at the same time
+	pushMsg := *msg
+	pushMsg.Seq = proto.Uint32(atomic.AddUint32(&s.seq, 1))
+	msgData, err := proto.Marshal(&pushMsg)
+	if err != nil {
+		return err
+	}
+	// drop response of msg which was timeout
+	select {
+	case <-s.resps:
+	default:
+	}
+	syncproto.LogMsg(s.conn, &pushMsg)
+	err = s.writeTo(newThrottledConn(s.conn, s.clientIp, moni), msgData)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(config.GetServerConf().GetLostSeconds()) * time.Second
+	select {
+	case resMsg := <-s.resps:
+		if resMsg.GetMsgType() != syncproto.PROTO_MSG_COMMON_RESP_OK {
+			return fmt.Errorf("client operate failed,resp msg type:%d,msgname:%s", resMsg.GetMsgType(), syncproto.GetMsgName(resMsg.GetMsgType()))
+		}
+		return nil
+	case <-s.closed:
+		return fmt.Errorf("conn:%s closed", s.conn.RemoteAddr().String())
+	case <-time.After(timeout):
+		return fmt.Errorf("wait response from conn:%s timeout", s.conn.RemoteAddr().String())
+	}
+}
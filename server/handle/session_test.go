@@ -0,0 +1,185 @@
+package handle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/wlibo666/filesync/lib/common"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func readTestMsg(t *testing.T, conn net.Conn) *syncproto.FileSyncProto {
+	msgData, err := common.ReadMsg(conn)
+	if err != nil {
+		t.Fatalf("ReadMsg failed,err:%s", err.Error())
+	}
+	msg := &syncproto.FileSyncProto{}
+	err = proto.Unmarshal(msgData, msg)
+	if err != nil {
+		t.Fatalf("proto.Unmarshal failed,err:%s", err.Error())
+	}
+	return msg
+}
+
+func writeTestMsg(t *testing.T, conn net.Conn, msgType uint32) {
+	writeTestSeqMsg(t, conn, msgType, nil)
+}
+
+func writeTestSeqMsg(t *testing.T, conn net.Conn, msgType uint32, seq *uint32) {
+	msgData, _ := proto.Marshal(&syncproto.FileSyncProto{
+		Version:    proto.Uint32(syncproto.PROTO_VERSION),
+		MsgType:    proto.Uint32(msgType),
+		ContentLen: proto.Uint32(0),
+		Seq:        seq,
+	})
+	err := common.WriteMsg(msgData, conn)
+	if err != nil {
+		t.Fatalf("WriteMsg failed,err:%s", err.Error())
+	}
+}
+
+func TestSinglePortSession(t *testing.T) {
+	maxRetry, interval := config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval
+	config.GetServerConf().MaxRetry = 1
+	config.GetServerConf().HeartBeatInterval = 1
+	defer func() {
+		config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval = maxRetry, interval
+		clientRwLock.Lock()
+		delete(ClientsAddr, "pipe")
+		delete(HeartBeatList, "pipe")
+		clientRwLock.Unlock()
+		clientInfoRwLock.Lock()
+		delete(clientInfos, "pipe")
+		clientInfoRwLock.Unlock()
+	}()
+
+	serverConn, clientConn := net.Pipe()
+	exited := make(chan bool)
+	go func() {
+		processHeartBeat(serverConn)
+		close(exited)
+	}()
+	writeTestMsg(t, clientConn, syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ)
+	msg := readTestMsg(t, clientConn)
+	if msg.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_RES {
+		t.Fatalf("expect heartbeat response,got:%s", syncproto.GetMsgName(msg.GetMsgType()))
+	}
+
+	// msg to client is pushed on heartbeat conn instead of dialing client port
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendMsgToClient("pipe:9091", nil, &syncproto.FileSyncProto{
+			Version:    proto.Uint32(syncproto.PROTO_VERSION),
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_EXIST_REQ),
+			ContentLen: proto.Uint32(0),
+		})
+	}()
+	msg = readTestMsg(t, clientConn)
+	if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_EXIST_REQ || msg.Seq == nil {
+		t.Fatalf("expect pushed exist msg with seq,got:%s", syncproto.GetMsgName(msg.GetMsgType()))
+	}
+	// response of other msg is not taken as response of this one
+	writeTestSeqMsg(t, clientConn, syncproto.PROTO_MSG_COMMON_RESP_FAIL, proto.Uint32(msg.GetSeq()-1))
+	writeTestSeqMsg(t, clientConn, syncproto.PROTO_MSG_COMMON_RESP_OK, msg.Seq)
+	if err := <-sent; err != nil {
+		t.Fatalf("sendMsgToClient failed,err:%s", err.Error())
+	}
+
+	clientConn.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("processHeartBeat not exit after conn closed")
+	}
+	if getSession("pipe") != nil {
+		t.Fatalf("session not removed after conn closed")
+	}
+}
+
+func TestHeartBeatDuringThrottledPush(t *testing.T) {
+	maxRetry, interval := config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval
+	config.GetServerConf().MaxRetry = 1
+	config.GetServerConf().HeartBeatInterval = 1
+	config.GetServerConf().RateLimit = &config.RateLimitConf{BytesPerSec: 1000, Burst: 1000}
+	defer func() {
+		config.GetServerConf().MaxRetry, config.GetServerConf().HeartBeatInterval = maxRetry, interval
+		config.GetServerConf().RateLimit = nil
+		getLimiter("global", nil)
+		clientRwLock.Lock()
+		delete(ClientsAddr, "pipe")
+		delete(HeartBeatList, "pipe")
+		clientRwLock.Unlock()
+		clientInfoRwLock.Lock()
+		delete(clientInfos, "pipe")
+		clientInfoRwLock.Unlock()
+	}()
+
+	serverConn, clientConn := net.Pipe()
+	exited := make(chan bool)
+	go func() {
+		processHeartBeat(serverConn)
+		close(exited)
+	}()
+	writeTestMsg(t, clientConn, syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ)
+	readTestMsg(t, clientConn)
+	msgs := make(chan *syncproto.FileSyncProto, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			msgs <- readTestMsg(t, clientConn)
+		}
+	}()
+
+	// pushing 3000 bytes at 1000 bytes/s takes about 2 seconds
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendMsgToClient("pipe:9091", nil, &syncproto.FileSyncProto{
+			Version:    proto.Uint32(syncproto.PROTO_VERSION),
+			MsgType:    proto.Uint32(syncproto.PROTO_MSG_FILE_WRITE_REQ),
+			ContentLen: proto.Uint32(3000),
+			Content:    make([]byte, 3000),
+		})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	clientRwLock.Lock()
+	HeartBeatList["pipe"] = 0
+	clientRwLock.Unlock()
+	writeTestMsg(t, clientConn, syncproto.PROTO_MSG_HEART_BETA_PUSH_REQ)
+	// heartbeat is answered while push is in flight,so client is not lost
+	answered := false
+	for i := 0; i < 10 && !answered; i++ {
+		time.Sleep(50 * time.Millisecond)
+		clientRwLock.RLock()
+		answered = HeartBeatList["pipe"] != 0
+		clientRwLock.RUnlock()
+	}
+	if !answered {
+		t.Fatalf("heartbeat is not answered while push is in flight")
+	}
+	select {
+	case <-msgs:
+		t.Fatalf("push should still be in flight")
+	default:
+	}
+
+	// response of heartbeat follows pushed msg,which is not broken by it
+	msg := <-msgs
+	if msg.GetMsgType() != syncproto.PROTO_MSG_FILE_WRITE_REQ || len(msg.GetContent()) != 3000 {
+		t.Fatalf("expect pushed write msg,got:%s", syncproto.GetMsgName(msg.GetMsgType()))
+	}
+	if res := <-msgs; res.GetMsgType() != syncproto.PROTO_MSG_HEART_BETA_RES {
+		t.Fatalf("expect heartbeat response,got:%s", syncproto.GetMsgName(res.GetMsgType()))
+	}
+	writeTestSeqMsg(t, clientConn, syncproto.PROTO_MSG_COMMON_RESP_OK, msg.Seq)
+	if err := <-sent; err != nil {
+		t.Fatalf("sendMsgToClient failed,err:%s", err.Error())
+	}
+	clientConn.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("processHeartBeat not exit after conn closed")
+	}
+}
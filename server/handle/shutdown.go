@@ -0,0 +1,174 @@
+package handle
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+var (
+	shuttingDown = int32(0)
+	stopWorkers  = make(chan bool)
+
+	// events being processed by workers
+	inflightEvents = make(map[fsnotify.Event]int)
+	inflightLock   = sync.Mutex{}
+	// list and fetch requests being processed
+	inflightRequests = int32(0)
+)
+
+// PendingEvent is event persisted when shutdown
+type PendingEvent struct {
+	Name string `json:"name"`
+	Op   uint32 `json:"op"`
+}
+
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func beginEvent(event fsnotify.Event) {
+	inflightLock.Lock()
+	inflightEvents[event]++
+	inflightLock.Unlock()
+}
+
+func endEvent(event fsnotify.Event) {
+	inflightLock.Lock()
+	inflightEvents[event]--
+	if inflightEvents[event] <= 0 {
+		delete(inflightEvents, event)
+	}
+	inflightLock.Unlock()
+}
+
+func getInflightEvents() []fsnotify.Event {
+	inflightLock.Lock()
+	defer inflightLock.Unlock()
+	events := make([]fsnotify.Event, 0, len(inflightEvents))
+	for event := range inflightEvents {
+		events = append(events, event)
+	}
+	return events
+}
+
+// stopMoniDir stop watching dir,return false if it is not watched
+func stopMoniDir(dirName string) bool {
+	dirRwLock.Lock()
+	defer dirRwLock.Unlock()
+	done, ok := moniDirNames[dirName]
+	if !ok {
+		return false
+	}
+	close(done)
+	delete(moniDirNames, dirName)
+	return true
+}
+
+// stopWatchers stop watching all dirs
+func stopWatchers() {
+	dirRwLock.Lock()
+	defer dirRwLock.Unlock()
+	for dirName, done := range moniDirNames {
+		close(done)
+		delete(moniDirNames, dirName)
+	}
+}
+
+// Shutdown stop accepting new clients and events,then wait queued and in-flight
+// events to be sent and requests being processed in timeout,return false if timeout.
+// events not sent are saved to pending_events or kept in event_wal
+func Shutdown(timeout time.Duration) bool {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return false
+	}
+	defer common.GJsonLog.Close()
+	defer wal.close()
+	log.Logger.Info("shutdown,wait %d events in %s", eventQueue.len(), timeout.String())
+	common.CloseListeners()
+	stopWatchers()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if eventQueue.len() == 0 && len(getInflightEvents()) == 0 && atomic.LoadInt32(&inflightRequests) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(stopWorkers)
+
+	requests := atomic.LoadInt32(&inflightRequests)
+	if requests > 0 {
+		log.Logger.Warn("shutdown,%d requests being processed are not done in %s", requests, timeout.String())
+	}
+	events := append(getInflightEvents(), eventQueue.drain()...)
+	if len(events) == 0 {
+		log.Logger.Info("shutdown,all events are sent")
+		return requests == 0
+	}
+	// events are still pending in wal and restored from it,saving them again queues them twice
+	if wal != nil {
+		log.Logger.Info("shutdown,%d events not sent are kept in event_wal", len(events))
+		return false
+	}
+	if config.GetServerConf().PendingEvents == "" {
+		log.Logger.Warn("shutdown,drop %d events not sent,pending_events is not set", len(events))
+		return false
+	}
+	err := savePendingEvents(config.GetServerConf().PendingEvents, events)
+	if err != nil {
+		log.Logger.Error("save %d pending events to %s failed,err:%s", len(events), config.GetServerConf().PendingEvents, err.Error())
+		return false
+	}
+	log.Logger.Info("shutdown,save %d pending events to %s", len(events), config.GetServerConf().PendingEvents)
+	return false
+}
+
+func savePendingEvents(filename string, events []fsnotify.Event) error {
+	pendings := make([]*PendingEvent, 0, len(events))
+	for _, event := range events {
+		pendings = append(pendings, &PendingEvent{Name: event.Name, Op: uint32(event.Op)})
+	}
+	data, err := json.Marshal(pendings)
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// loadPendingEvents queue events saved by last shutdown
+func loadPendingEvents(filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Logger.Error("read pending events from %s failed,err:%s", filename, err.Error())
+		}
+		return
+	}
+	pendings := make([]*PendingEvent, 0)
+	err = json.Unmarshal(data, &pendings)
+	if err != nil {
+		log.Logger.Error("parse pending events from %s failed,err:%s", filename, err.Error())
+		return
+	}
+	os.Remove(filename)
+	log.Logger.Info("load %d pending events from %s", len(pendings), filename)
+	go func() {
+		for _, pending := range pendings {
+			eventQueue.push(fsnotify.Event{Name: pending.Name, Op: fsnotify.Op(pending.Op)}, getEventPriority(pending.Name), stopWorkers)
+		}
+	}()
+}
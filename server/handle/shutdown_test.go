@@ -0,0 +1,78 @@
+package handle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// resetShutdown restore state changed by Shutdown,so tests run after it are not affected
+func resetShutdown() {
+	atomic.StoreInt32(&shuttingDown, 0)
+	stopWorkers = make(chan bool)
+	eventQueue.drain()
+}
+
+func TestShutdown(t *testing.T) {
+	defer resetShutdown()
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	config.GetServerConf().PendingEvents = filepath.Join(tmpDir, "pending.json")
+	defer func() { config.GetServerConf().PendingEvents = "" }()
+
+	// no worker is running,events are left in queue
+	eventQueue.push(fsnotify.Event{Name: "/data/a.txt", Op: fsnotify.Write}, EVENT_PRIORITY_LIVE, nil)
+	beginEvent(fsnotify.Event{Name: "/data/b.txt", Op: fsnotify.Create})
+	if Shutdown(100 * time.Millisecond) {
+		t.Fatalf("shutdown should not drain with events not sent")
+	}
+	if !IsShuttingDown() || eventQueue.len() != 0 {
+		t.Fatalf("shutdown should drain queue,len:%d", eventQueue.len())
+	}
+	endEvent(fsnotify.Event{Name: "/data/b.txt", Op: fsnotify.Create})
+
+	loadPendingEvents(config.GetServerConf().PendingEvents)
+	events := make(map[string]fsnotify.Op)
+	for i := 0; i < 2; i++ {
+		timeout := make(chan bool)
+		timer := time.AfterFunc(time.Second, func() { close(timeout) })
+		event, ok := eventQueue.pop(timeout)
+		timer.Stop()
+		if !ok {
+			t.Fatalf("pending events are not loaded,got:%v", events)
+		}
+		events[event.Name] = event.Op
+	}
+	if events["/data/a.txt"] != fsnotify.Write || events["/data/b.txt"] != fsnotify.Create {
+		t.Fatalf("pending events are %v", events)
+	}
+	_, err = os.Stat(config.GetServerConf().PendingEvents)
+	if !os.IsNotExist(err) {
+		t.Fatalf("pending events file should be removed after load,err:%v", err)
+	}
+}
+
+func TestShutdownWaitRequests(t *testing.T) {
+	defer resetShutdown()
+	atomic.AddInt32(&inflightRequests, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&inflightRequests, -1)
+	}()
+	start := time.Now()
+	if !Shutdown(2 * time.Second) {
+		t.Fatalf("shutdown should drain after request is done")
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("shutdown should wait request being processed")
+	}
+}
@@ -0,0 +1,144 @@
+package handle
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/server/config"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// waits longer than this are logged
+	THROTTLE_LOG_WAIT = time.Second
+)
+
+// limiter limit bytes sent of one scope,eg. global, client:<ip> or dir:<name>,
+// its rate follows config and schedules
+type limiter struct {
+	scope       string
+	limiter     *rate.Limiter
+	bytesPerSec int64
+	burst       int64
+}
+
+var (
+	limiters    = make(map[string]*limiter)
+	limiterLock = sync.Mutex{}
+)
+
+// getLimiter return limiter of scope with rate of conf now,nil if there is no limit
+func getLimiter(scope string, conf *config.RateLimitConf) *limiter {
+	bytesPerSec, burst := conf.GetRate(time.Now())
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+	l, ok := limiters[scope]
+	if bytesPerSec <= 0 {
+		if ok {
+			delete(limiters, scope)
+			rateLimitBytes.DeleteLabelValues(scope)
+			log.Logger.Info("rate limit of %s is removed", scope)
+		}
+		return nil
+	}
+	if ok && l.bytesPerSec == bytesPerSec && l.burst == burst {
+		return l
+	}
+	if !ok {
+		l = &limiter{scope: scope, limiter: rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))}
+		limiters[scope] = l
+	} else {
+		l.limiter.SetLimit(rate.Limit(bytesPerSec))
+		l.limiter.SetBurst(int(burst))
+	}
+	l.bytesPerSec, l.burst = bytesPerSec, burst
+	rateLimitBytes.WithLabelValues(scope).Set(float64(bytesPerSec))
+	log.Logger.Info("rate limit of %s is %d bytes/s,burst:%d", scope, bytesPerSec, burst)
+	return l
+}
+
+// getSendLimiters return limiters of bytes of moni dir sent to client,by global
+// rate_limit,client_rate_limit and rate_limit of moni dir which may be nil
+func getSendLimiters(clientIp string, moni *config.FileSyncMoniConf) []*limiter {
+	limiters := make([]*limiter, 0, 3)
+	confs := map[string]*config.RateLimitConf{
+		"global":             config.GetServerConf().RateLimit,
+		"client:" + clientIp: config.GetServerConf().ClientRateLimit,
+	}
+	if moni != nil {
+		confs["dir:"+moni.GetName()] = moni.RateLimit
+	}
+	for scope, conf := range confs {
+		if l := getLimiter(scope, conf); l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
+
+// throttledConn write to client at the rate of its limiters,data is written in chunks
+// of the smallest burst and every chunk waits the longest delay of all limiters
+type throttledConn struct {
+	net.Conn
+	clientIp string
+	limiters []*limiter
+}
+
+// newThrottledConn return conn which sends bytes of moni dir to client in rate limits
+func newThrottledConn(conn net.Conn, clientIp string, moni *config.FileSyncMoniConf) net.Conn {
+	return &throttledConn{
+		Conn:     conn,
+		clientIp: clientIp,
+		limiters: getSendLimiters(clientIp, moni),
+	}
+}
+
+// reserve take n bytes from all limiters and return the longest delay
+func (c *throttledConn) reserve(n int) time.Duration {
+	now := time.Now()
+	delay := time.Duration(0)
+	for _, l := range c.limiters {
+		r := l.limiter.ReserveN(now, n)
+		if !r.OK() {
+			// burst is changed by reload,not limited this time
+			continue
+		}
+		waited := r.DelayFrom(now)
+		throttleWaitSeconds.WithLabelValues(l.scope).Add(waited.Seconds())
+		if waited > delay {
+			delay = waited
+		}
+	}
+	return delay
+}
+
+// chunkSize return bytes written at a time,it is the smallest burst of limiters
+func (c *throttledConn) chunkSize(n int) int {
+	for _, l := range c.limiters {
+		if burst := l.limiter.Burst(); burst > 0 && n > burst {
+			n = burst
+		}
+	}
+	return n
+}
+
+func (c *throttledConn) Write(data []byte) (int, error) {
+	start := time.Now()
+	written := 0
+	for written < len(data) {
+		size := c.chunkSize(len(data) - written)
+		time.Sleep(c.reserve(size))
+		n, err := c.Conn.Write(data[written : written+size])
+		written += n
+		clientSentBytes.WithLabelValues(c.clientIp).Add(float64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	if waited := time.Since(start); len(c.limiters) > 0 && waited >= THROTTLE_LOG_WAIT {
+		log.Logger.Info("throttled by rate limit to client:%s,wait %s for %d bytes", c.clientIp, waited.String(), len(data))
+	}
+	return written, nil
+}
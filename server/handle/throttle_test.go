@@ -0,0 +1,58 @@
+package handle
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wlibo666/filesync/server/config"
+)
+
+// recordConn record sizes of writes
+type recordConn struct {
+	net.Conn
+	writes []int
+}
+
+func (c *recordConn) Write(data []byte) (int, error) {
+	c.writes = append(c.writes, len(data))
+	return len(data), nil
+}
+
+func TestThrottledConn(t *testing.T) {
+	config.GetServerConf().RateLimit = &config.RateLimitConf{BytesPerSec: 10000}
+	config.GetServerConf().ClientRateLimit = &config.RateLimitConf{BytesPerSec: 10000}
+	moni := &config.FileSyncMoniConf{Name: "code", DirName: "/data/code", RateLimit: &config.RateLimitConf{BytesPerSec: 10000, Burst: 5000}}
+	defer func() {
+		config.GetServerConf().RateLimit = nil
+		config.GetServerConf().ClientRateLimit = nil
+	}()
+
+	start := time.Now()
+	conn := &recordConn{}
+	// written in chunks of the smallest burst 5000,every chunk waits the longest
+	// delay of the limits,so the last 10000 bytes wait about 1 second
+	n, err := newThrottledConn(conn, "192.168.1.104", moni).Write(make([]byte, 15000))
+	waited := time.Since(start)
+	if err != nil || n != 15000 {
+		t.Fatalf("Write return %d,err:%v", n, err)
+	}
+	if waited < 800*time.Millisecond || waited > 2*time.Second {
+		t.Fatalf("throttled write should wait about 1 second,waited:%s", waited.String())
+	}
+	if len(conn.writes) != 3 || conn.writes[0] != 5000 {
+		t.Fatalf("writes are %v,want 3 chunks of 5000", conn.writes)
+	}
+
+	config.GetServerConf().RateLimit = nil
+	config.GetServerConf().ClientRateLimit = nil
+	start = time.Now()
+	conn = &recordConn{}
+	newThrottledConn(conn, "192.168.1.104", nil).Write(make([]byte, 15000))
+	if waited := time.Since(start); waited > 100*time.Millisecond || len(conn.writes) != 1 {
+		t.Fatalf("write without limit should not wait,waited:%s,writes:%v", waited.String(), conn.writes)
+	}
+	if getLimiter("global", nil) != nil {
+		t.Fatalf("limiter should be removed without limit")
+	}
+}
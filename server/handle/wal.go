@@ -0,0 +1,296 @@
+package handle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/wlibo666/common-lib/log"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+)
+
+const (
+	// wal is rewritten with pending records when acked records are more than this
+	WAL_COMPACT_RECORDS = 1000
+)
+
+// walRecord is one line of wal: an event queued if client is empty,
+// an op sent to client otherwise,or ack of record Id
+type walRecord struct {
+	Id     uint64 `json:"id"`
+	Ack    bool   `json:"ack,omitempty"`
+	Client string `json:"client,omitempty"`
+	File   string `json:"file,omitempty"`
+	Op     uint32 `json:"op,omitempty"`
+}
+
+// eventWal is append-only file of pending events and per client ops,
+// records are pending until acked,so they survive restart
+type eventWal struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	nextId   uint64
+	pending  map[uint64]*walRecord
+	// ids of pending ops by client and file
+	clientFiles map[string]map[uint64]bool
+	acked       int
+}
+
+var (
+	// disabled if nil
+	wal *eventWal
+)
+
+// OpenWal open event_wal file,pending records of last run are restored by MoniFilesAndSync
+func OpenWal(filename string) error {
+	w, err := openEventWal(filename)
+	if err != nil {
+		return err
+	}
+	wal = w
+	return nil
+}
+
+func openEventWal(filename string) (*eventWal, error) {
+	w := &eventWal{
+		filename:    filename,
+		pending:     make(map[uint64]*walRecord),
+		clientFiles: make(map[string]map[uint64]bool),
+	}
+	f, err := os.Open(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record := &walRecord{}
+			// last line may be partly written when crash
+			if json.Unmarshal(scanner.Bytes(), record) != nil {
+				log.Logger.Warn("skip invalid record of wal:%s", filename)
+				continue
+			}
+			w.apply(record)
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	err = w.compact()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func walClientKey(ipAddr, filename string) string {
+	return ipAddr + "\x00" + filename
+}
+
+// addPending add record to pending records and their indexes
+func (w *eventWal) addPending(record *walRecord) {
+	w.pending[record.Id] = record
+	if record.Client == "" {
+		return
+	}
+	key := walClientKey(record.Client, record.File)
+	if w.clientFiles[key] == nil {
+		w.clientFiles[key] = make(map[uint64]bool)
+	}
+	w.clientFiles[key][record.Id] = true
+}
+
+// removePending remove record of id from pending records and their indexes
+func (w *eventWal) removePending(id uint64) {
+	record, ok := w.pending[id]
+	if !ok {
+		return
+	}
+	delete(w.pending, id)
+	if record.Client == "" {
+		return
+	}
+	key := walClientKey(record.Client, record.File)
+	delete(w.clientFiles[key], id)
+	if len(w.clientFiles[key]) == 0 {
+		delete(w.clientFiles, key)
+	}
+}
+
+// apply replay record into pending records
+func (w *eventWal) apply(record *walRecord) {
+	if record.Id >= w.nextId {
+		w.nextId = record.Id + 1
+	}
+	if record.Ack {
+		w.removePending(record.Id)
+		return
+	}
+	w.addPending(record)
+}
+
+// compact rewrite wal with pending records only,then reopen it to append
+func (w *eventWal) compact() error {
+	if w.file != nil {
+		w.file.Close()
+	}
+	tmpFile := w.filename + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for _, record := range w.getPending() {
+		data, _ := json.Marshal(record)
+		writer.Write(append(data, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, w.filename)
+	if err != nil {
+		return err
+	}
+	w.acked = 0
+	w.file, err = os.OpenFile(w.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// getPending return pending records sorted by id
+func (w *eventWal) getPending() []*walRecord {
+	records := make([]*walRecord, 0, len(w.pending))
+	for _, record := range w.pending {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Id < records[j].Id
+	})
+	return records
+}
+
+// write append record to wal,added records are synced to disk so they survive power loss,
+// acks are not,a lost ack only makes its record processed again
+func (w *eventWal) write(record *walRecord) {
+	data, _ := json.Marshal(record)
+	_, err := w.file.Write(append(data, '\n'))
+	if err == nil && !record.Ack {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		log.Logger.Error("write wal:%s failed,err:%s", w.filename, err.Error())
+	}
+}
+
+// add record as pending and return its id
+func (w *eventWal) add(record *walRecord) uint64 {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	record.Id = w.nextId
+	w.nextId++
+	w.addPending(record)
+	w.write(record)
+	return record.Id
+}
+
+// ack remove pending record of id,wal is compacted when many are acked.
+// lock must be held
+func (w *eventWal) ack(id uint64) {
+	w.removePending(id)
+	w.write(&walRecord{Id: id, Ack: true})
+	w.acked++
+	if w.acked > WAL_COMPACT_RECORDS && w.acked > len(w.pending) {
+		err := w.compact()
+		if err != nil {
+			log.Logger.Error("compact wal:%s failed,err:%s", w.filename, err.Error())
+		}
+	}
+}
+
+// addEvent record event queued,return id of its record which is queued with it
+func (w *eventWal) addEvent(event fsnotify.Event) uint64 {
+	return w.add(&walRecord{File: event.Name, Op: uint32(event.Op)})
+}
+
+// ackEvent ack record of event by id after it is processed
+func (w *eventWal) ackEvent(id uint64) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.pending[id]; ok {
+		w.ack(id)
+	}
+}
+
+// addClientOp record op of file being sent to client
+func (w *eventWal) addClientOp(ipAddr, filename string, msgType uint32) {
+	w.add(&walRecord{Client: ipAddr, File: filename, Op: msgType})
+}
+
+// ackClientFile ack all pending ops of file to client after client acknowledged latest state
+func (w *eventWal) ackClientFile(ipAddr, filename string) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for id := range w.clientFiles[walClientKey(ipAddr, filename)] {
+		w.ack(id)
+	}
+}
+
+func (w *eventWal) pendingLen() int {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.pending)
+}
+
+func (w *eventWal) close() {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.file.Close()
+}
+
+// restoreWal queue events and retry client ops which are pending in wal
+func restoreWal() {
+	if wal == nil {
+		return
+	}
+	wal.lock.Lock()
+	records := wal.getPending()
+	wal.lock.Unlock()
+	events, ops := 0, 0
+	for _, record := range records {
+		if record.Client == "" {
+			event := fsnotify.Event{Name: record.File, Op: fsnotify.Op(record.Op)}
+			eventQueue.pushWal(event, record.Id, getEventPriority(event.Name), stopWorkers)
+			events++
+			continue
+		}
+		addRetry(record.Client, record.File, syncproto.GetMsgName(record.Op), fmt.Errorf("restored from wal"))
+		ops++
+	}
+	log.Logger.Info("restore %d events and %d client ops from wal:%s", events, ops, wal.filename)
+}
@@ -0,0 +1,113 @@
+package handle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	syncproto "github.com/wlibo666/filesync/lib/proto"
+	"github.com/wlibo666/filesync/server/config"
+)
+
+func TestEventWal(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	walFile := filepath.Join(tmpDir, "events.wal")
+
+	w, err := openEventWal(walFile)
+	if err != nil {
+		t.Fatalf("openEventWal failed,err:%s", err.Error())
+	}
+	event := fsnotify.Event{Name: "/data/a.txt", Op: fsnotify.Write}
+	id1 := w.addEvent(event)
+	id2 := w.addEvent(event)
+	w.addClientOp("192.168.1.104:9091", "/data/a.txt", syncproto.PROTO_MSG_FILE_WRITE_REQ)
+	w.addClientOp("192.168.1.105:9091", "/data/a.txt", syncproto.PROTO_MSG_FILE_WRITE_REQ)
+	w.ackEvent(id2)
+	w.ackClientFile("192.168.1.105:9091", "/data/a.txt")
+	w.close()
+	// partly written record when crash is skipped
+	f, _ := os.OpenFile(walFile, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte(`{"id":9,"fi`))
+	f.Close()
+
+	w, err = openEventWal(walFile)
+	if err != nil {
+		t.Fatalf("openEventWal again failed,err:%s", err.Error())
+	}
+	records := w.getPending()
+	if len(records) != 2 || records[0].Id != id1 || records[0].File != "/data/a.txt" || records[1].Client != "192.168.1.104:9091" {
+		t.Fatalf("pending records after restart are %+v", records)
+	}
+
+	// acked records are compacted
+	w.ackEvent(id1)
+	w.ackClientFile("192.168.1.104:9091", "/data/a.txt")
+	for i := 0; i <= WAL_COMPACT_RECORDS; i++ {
+		w.ackEvent(w.addEvent(event))
+	}
+	w.addEvent(event)
+	w.close()
+	data, _ := ioutil.ReadFile(walFile)
+	if lines := bytes.Count(data, []byte("\n")); lines > 10 {
+		t.Fatalf("wal is not compacted,lines:%d", lines)
+	}
+	w, err = openEventWal(walFile)
+	if err != nil || w.pendingLen() != 1 {
+		t.Fatalf("pending records after compact is %d,err:%v", w.pendingLen(), err)
+	}
+	w.close()
+}
+
+func TestShutdownWithWal(t *testing.T) {
+	defer resetShutdown()
+	tmpDir, err := ioutil.TempDir("", "filesync")
+	if err != nil {
+		t.Fatalf("TempDir failed,err:%s", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	config.GetServerConf().PendingEvents = filepath.Join(tmpDir, "pending.json")
+	defer func() { config.GetServerConf().PendingEvents = "" }()
+	err = OpenWal(filepath.Join(tmpDir, "events.wal"))
+	if err != nil {
+		t.Fatalf("OpenWal failed,err:%s", err.Error())
+	}
+	defer func() { wal = nil }()
+
+	event := fsnotify.Event{Name: "/data/a.txt", Op: fsnotify.Write}
+	eventQueue.pushWal(event, wal.addEvent(event), EVENT_PRIORITY_LIVE, nil)
+	Shutdown(100 * time.Millisecond)
+	// event is restored from wal only
+	_, err = os.Stat(config.GetServerConf().PendingEvents)
+	if !os.IsNotExist(err) {
+		t.Fatalf("pending events should not be saved with event_wal,err:%v", err)
+	}
+	w, err := openEventWal(filepath.Join(tmpDir, "events.wal"))
+	if err != nil || w.pendingLen() != 1 {
+		t.Fatalf("pending records of wal is %d,err:%v", w.pendingLen(), err)
+	}
+	w.close()
+}
+
+func TestQueueWalId(t *testing.T) {
+	event := fsnotify.Event{Name: "/data/a.txt", Op: fsnotify.Write}
+	q := newPriorityQueue()
+	q.pushWal(event, 7, EVENT_PRIORITY_LIVE, nil)
+	// reconcile event of the same file is not in wal,so it acks nothing
+	q.push(event, EVENT_PRIORITY_RECONCILE, nil)
+	item, ok := q.tryPopItem()
+	if !ok || !item.inWal || item.walId != 7 {
+		t.Fatalf("live event should carry its wal id,got:%+v", item)
+	}
+	item, ok = q.tryPopItem()
+	if !ok || item.inWal {
+		t.Fatalf("reconcile event should not be in wal,got:%+v", item)
+	}
+}
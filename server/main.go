@@ -5,46 +5,120 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/wlibo666/common-lib/log"
+	"github.com/wlibo666/filesync/lib/common"
 	"github.com/wlibo666/filesync/server/config"
 	"github.com/wlibo666/filesync/server/handle"
 )
 
 var (
-	ConfFile = flag.String("conf", "C:\\syncprogram\\server.json", "config file,eg: -conf ./conf/server.json")
+	DryRun      = flag.Bool("dry-run", false, "only log what would be done,eg: -dry-run")
+	CheckConfig = flag.Bool("check-config", false, "check config file then exit,eg: -check-config")
+	ConfFile    = flag.String("conf", "C:\\syncprogram\\server.json", "config file,eg: -conf ./conf/server.json")
 )
 
 func RegistryCtlCSignal() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func(c chan os.Signal) {
 		sig := <-c
 		log.Logger.Info("recv signal:%s then exit", sig.String())
-		os.Exit(2)
+		drained := handle.Shutdown(time.Duration(config.GetServerConf().ShutdownTimeout) * time.Second)
+		common.GHashCache.Save()
+		if common.DryRun {
+			log.Logger.Info("%s", common.DryRunSummary())
+			fmt.Fprintf(os.Stdout, "%s\n", common.DryRunSummary())
+		}
+		if !drained {
+			os.Exit(2)
+		}
+		os.Exit(0)
 	}(c)
 }
 
+// RegistryReloadSignal reload config on SIGHUP
+func RegistryReloadSignal() {
+	c := make(chan os.Signal, 1)
+	common.NotifyReload(c)
+	go func(c chan os.Signal) {
+		for sig := range c {
+			log.Logger.Info("recv signal:%s then reload config", sig.String())
+			handle.Reload()
+		}
+	}(c)
+}
+
+// RunCheckConfig print problems of config file,return exit code
+func RunCheckConfig() int {
+	errs := config.CheckConfig(*ConfFile)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "config [%s] has %d problems\n", *ConfFile, len(errs))
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "config [%s] is ok\n", *ConfFile)
+	return 0
+}
+
 func main() {
 	flag.Parse()
+	if *CheckConfig {
+		os.Exit(RunCheckConfig())
+	}
 	Prepare()
 	RegistryCtlCSignal()
+	RegistryReloadSignal()
 	log.Logger.Info("program [%s] start...", os.Args[0])
 
 	handle.StartHeartBeatListener()
+	if config.GetServerConf().MetricsListen != "" {
+		common.StartMetricsListener(config.GetServerConf().MetricsListen)
+	}
+	if config.GetServerConf().AdminListen != "" {
+		handle.StartAdminListener(config.GetServerConf().AdminListen)
+	}
+	handle.StartSnapshotMarkers()
 	handle.MoniFilesAndSync()
-	log.Logger.Info("program [%s] exit...", os.Args[0])
+	// MoniFilesAndSync return when shutdown,wait it to exit
+	select {}
 }
 
 func Prepare() error {
+	common.DryRun = *DryRun
 	err := config.LoadConfig(*ConfFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "LoadConfig [%s] failed,err:%s\n", *ConfFile, err.Error())
 		os.Exit(1)
 	}
-	log.SetFileLogger(config.GServerConf.LogFile, config.GServerConf.LogFileNum)
-	if config.GServerConf.DebugFlag {
+	log.SetFileLogger(config.GetServerConf().LogFile, config.GetServerConf().LogFileNum)
+	if config.GetServerConf().DebugFlag {
 		log.SetLoggerDebug()
 	}
+	if config.GetServerConf().JsonLog != "" {
+		common.GJsonLog, err = common.NewJsonLogger(config.GetServerConf().JsonLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open json log [%s] failed,err:%s\n", config.GetServerConf().JsonLog, err.Error())
+			os.Exit(1)
+		}
+	}
+	if config.GetServerConf().EventWal != "" {
+		err = handle.OpenWal(config.GetServerConf().EventWal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open event wal [%s] failed,err:%s\n", config.GetServerConf().EventWal, err.Error())
+			os.Exit(1)
+		}
+	}
+	if config.GetServerConf().HashCache != "" {
+		err = common.LoadHashCache(config.GetServerConf().HashCache)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadHashCache [%s] failed,err:%s\n", config.GetServerConf().HashCache, err.Error())
+			os.Exit(1)
+		}
+	}
 	return nil
 }